@@ -17,6 +17,7 @@ import (
 	"github.com/z0rr0/luss/auth"
 	"github.com/z0rr0/luss/conf"
 	"github.com/z0rr0/luss/core"
+	"github.com/z0rr0/luss/device"
 	"github.com/z0rr0/luss/trim"
 )
 
@@ -45,22 +46,85 @@ type addCbRequest struct {
 	Value  string `json:"value"`
 }
 
+// targetItem is a weighted target of short URL.
+type targetItem struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// geoItem is a geo rule of short URL.
+type geoItem struct {
+	Countries []string `json:"countries"`
+	URL       string   `json:"url"`
+}
+
 // addRequest is JSON API add request data.
 type addRequest struct {
-	URL       string       `json:"url"`
-	Tag       string       `json:"tag"`
-	TTL       uint64       `json:"ttl"`
-	NotDirect bool         `json:"nd"`
-	Group     string       `json:"group"`
-	Cb        addCbRequest `json:"cb"`
+	URL       string        `json:"url"`
+	Alias     string        `json:"alias"`
+	Random    bool          `json:"random"`
+	Dedup     bool          `json:"dedup"`
+	Tag       string        `json:"tag"`
+	TTL       uint64        `json:"ttl"`
+	Expire    string        `json:"expire"`
+	Clicks    int64         `json:"clicks"`
+	Password  string        `json:"password"`
+	NotDirect bool          `json:"nd"`
+	Group     string        `json:"group"`
+	Targets   []targetItem  `json:"targets"`
+	Sticky    bool          `json:"sticky"`
+	Geo       []geoItem     `json:"geo"`
+	Devices   []device.Rule `json:"devices"`
+	Query     string        `json:"query"`
+	Suffix    bool          `json:"suffix"`
+	Code      int           `json:"code"`
+	Cb        addCbRequest  `json:"cb"`
+}
+
+// editRequest is JSON API edit request data.
+type editRequest struct {
+	Short     string         `json:"short"`
+	URL       *string        `json:"url"`
+	Tag       *string        `json:"tag"`
+	TTL       *uint64        `json:"ttl"`
+	Expire    *string        `json:"expire"`
+	Clicks    *int64         `json:"clicks"`
+	Password  *string        `json:"password"`
+	NotDirect *bool          `json:"nd"`
+	Group     *string        `json:"group"`
+	Targets   *[]targetItem  `json:"targets"`
+	Sticky    *bool          `json:"sticky"`
+	Geo       *[]geoItem     `json:"geo"`
+	Devices   *[]device.Rule `json:"devices"`
+	Query     *string        `json:"query"`
+	Suffix    *bool          `json:"suffix"`
+	Code      *int           `json:"code"`
+	Cb        *addCbRequest  `json:"cb"`
+}
+
+// healthResponse is a result of original URL health checks.
+type healthResponse struct {
+	Status  int    `json:"status"`
+	Err     string `json:"error"`
+	Checked string `json:"checked"`
+	Fails   int    `json:"fails"`
+	Flagged bool   `json:"flagged"`
 }
 
 // addResponseItem is a item of response for add request.
 type addResponseItem struct {
-	ID       string `json:"id"`
-	Original string `json:"url"`
-	Short    string `json:"short"`
-	Err      string `json:"error"`
+	ID       string          `json:"id"`
+	Original string          `json:"url"`
+	Short    string          `json:"short"`
+	Reused   bool            `json:"reused"`
+	Targets  []targetItem    `json:"targets,omitempty"`
+	Geo      []geoItem       `json:"geo,omitempty"`
+	Devices  []device.Rule   `json:"devices,omitempty"`
+	Query    string          `json:"query,omitempty"`
+	Suffix   bool            `json:"suffix,omitempty"`
+	Code     int             `json:"code,omitempty"`
+	Health   *healthResponse `json:"health,omitempty"`
+	Err      string          `json:"error"`
 }
 
 // addResponse is a response for add request.
@@ -151,12 +215,19 @@ type exportRequest struct {
 
 // exportResponseItem is a result item in export response.
 type exportResponseItem struct {
-	ID       string `json:"id"`
-	Short    string `json:"short"`
-	Original string `json:"url"`
-	Group    string `json:"group"`
-	Tag      string `json:"tag"`
-	Created  string `json:"created"`
+	ID       string          `json:"id"`
+	Short    string          `json:"short"`
+	Original string          `json:"url"`
+	Group    string          `json:"group"`
+	Tag      string          `json:"tag"`
+	Created  string          `json:"created"`
+	Targets  []targetItem    `json:"targets,omitempty"`
+	Geo      []geoItem       `json:"geo,omitempty"`
+	Devices  []device.Rule   `json:"devices,omitempty"`
+	Query    string          `json:"query,omitempty"`
+	Suffix   bool            `json:"suffix,omitempty"`
+	Code     int             `json:"code,omitempty"`
+	Health   *healthResponse `json:"health,omitempty"`
 }
 
 // exportResponse is a response for export request.
@@ -183,9 +254,75 @@ func (e *exportRequest) parsePeriod() ([2]*time.Time, error) {
 	return result, nil
 }
 
-// HandlerError returns JSON API response about the error.
-func HandlerError(w http.ResponseWriter, code int) error {
-	resp := shortResponse{Err: code, Msg: http.StatusText(code), Result: []bool{}}
+// targetParams converts request targets to short URL ones.
+func targetParams(items []targetItem) []trim.Target {
+	if len(items) == 0 {
+		return nil
+	}
+	targets := make([]trim.Target, len(items))
+	for i, item := range items {
+		targets[i] = trim.Target{URL: item.URL, Weight: item.Weight}
+	}
+	return targets
+}
+
+// targetItems converts short URL targets to response items.
+func targetItems(targets []trim.Target) []targetItem {
+	if len(targets) == 0 {
+		return nil
+	}
+	items := make([]targetItem, len(targets))
+	for i, t := range targets {
+		items[i] = targetItem{URL: t.URL, Weight: t.Weight}
+	}
+	return items
+}
+
+// geoParams converts request geo rules to short URL ones.
+func geoParams(items []geoItem) []trim.GeoRule {
+	if len(items) == 0 {
+		return nil
+	}
+	rules := make([]trim.GeoRule, len(items))
+	for i, item := range items {
+		rules[i] = trim.GeoRule{Countries: item.Countries, URL: item.URL}
+	}
+	return rules
+}
+
+// geoItems converts short URL geo rules to response items.
+func geoItems(rules []trim.GeoRule) []geoItem {
+	if len(rules) == 0 {
+		return nil
+	}
+	items := make([]geoItem, len(rules))
+	for i, rule := range rules {
+		items[i] = geoItem{Countries: rule.Countries, URL: rule.URL}
+	}
+	return items
+}
+
+// newHealthResponse returns health info of short URL or nil if it wasn't checked yet.
+func newHealthResponse(cu *trim.CustomURL) *healthResponse {
+	if cu.Health == nil {
+		return nil
+	}
+	return &healthResponse{
+		Status:  cu.Health.Status,
+		Err:     cu.Health.Err,
+		Checked: cu.Health.Checked.UTC().Format(time.RFC3339),
+		Fails:   cu.Health.Fails,
+		Flagged: cu.Health.Flagged,
+	}
+}
+
+// HandlerError returns JSON API response about the error,
+// HTTP status text is used if the message is empty.
+func HandlerError(w http.ResponseWriter, code int, msg string) error {
+	if msg == "" {
+		msg = http.StatusText(code)
+	}
+	resp := shortResponse{Err: code, Msg: msg, Result: []bool{}}
 	data, err := json.Marshal(resp)
 	if err != nil {
 		return err
@@ -198,10 +335,7 @@ func HandlerError(w http.ResponseWriter, code int) error {
 
 // validateParams checks HTTP parameters for add-request.
 func validateAddParams(r *http.Request) ([]*trim.ReqParams, error) {
-	var (
-		ars []addRequest
-		ttl *time.Time
-	)
+	var ars []addRequest
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(&ars)
 	if (err != nil) && (err != io.EOF) {
@@ -211,21 +345,30 @@ func validateAddParams(r *http.Request) ([]*trim.ReqParams, error) {
 	if n == 0 {
 		return nil, errors.New("empty request")
 	}
-	now := time.Now()
 	result := make([]*trim.ReqParams, n)
 	for i, ar := range ars {
-		if ar.TTL > 0 {
-			expire := now.Add(time.Duration(ar.TTL) * time.Hour).UTC()
-			ttl = &expire
-		} else {
-			ttl = nil
+		ttl, err := trim.ExpireTime(ar.TTL, ar.Expire)
+		if err != nil {
+			return nil, err
 		}
 		params := &trim.ReqParams{
 			Original:  ar.URL,
+			Alias:     ar.Alias,
+			Random:    ar.Random,
+			Dedup:     ar.Dedup,
 			Tag:       ar.Tag,
 			NotDirect: ar.NotDirect,
 			TTL:       ttl,
+			MaxClicks: ar.Clicks,
+			Password:  ar.Password,
 			Group:     ar.Group,
+			Targets:   targetParams(ar.Targets),
+			Sticky:    ar.Sticky,
+			Geo:       geoParams(ar.Geo),
+			Devices:   ar.Devices,
+			Query:     ar.Query,
+			Suffix:    ar.Suffix,
+			Code:      ar.Code,
 			IsAPI:     true,
 			Cb: trim.CallBack{
 				URL:    ar.Cb.URL,
@@ -256,6 +399,9 @@ func HandlerAdd(ctx context.Context, w http.ResponseWriter, r *http.Request) cor
 	}
 	cus, err := trim.Shorten(ctx, params)
 	if err != nil {
+		if _, ok := err.(*trim.PolicyError); ok || err == trim.ErrAliasUsed || err == trim.ErrSpam {
+			return core.ErrHandler{Err: err, Status: http.StatusBadRequest}
+		}
 		return core.ErrHandler{Err: err, Status: http.StatusInternalServerError}
 	}
 	items := make([]addResponseItem, len(cus))
@@ -265,6 +411,7 @@ func HandlerAdd(ctx context.Context, w http.ResponseWriter, r *http.Request) cor
 			ID:       id,
 			Short:    c.Address(id),
 			Original: cu.Original,
+			Reused:   cu.Reused,
 		}
 	}
 	result := &addResponse{
@@ -281,8 +428,156 @@ func HandlerAdd(ctx context.Context, w http.ResponseWriter, r *http.Request) cor
 	return core.ErrHandler{Err: nil, Status: http.StatusOK}
 }
 
-// HandlerGet returns info about short URLs.
-func HandlerGet(ctx context.Context, w http.ResponseWriter, r *http.Request) core.ErrHandler {
+// validateEditParams reads and checks edit request parameters.
+func validateEditParams(r *http.Request) ([]string, []*trim.ReqParams, error) {
+	var ers []editRequest
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&ers)
+	if (err != nil) && (err != io.EOF) {
+		return nil, nil, err
+	}
+	if len(ers) == 0 {
+		return nil, nil, ErrEmptyRequest
+	}
+	shorts, result := make([]string, len(ers)), make([]*trim.ReqParams, len(ers))
+	for i, er := range ers {
+		link, err := core.TrimAddress(er.Short)
+		if err != nil {
+			return nil, nil, err
+		}
+		short, ok := trim.IsShort(link)
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid short URL [%v]", er.Short)
+		}
+		params, err := er.params()
+		if err != nil {
+			return nil, nil, err
+		}
+		err = params.Valid()
+		if err != nil {
+			return nil, nil, err
+		}
+		shorts[i], result[i] = short, params
+	}
+	return shorts, result, nil
+}
+
+// params returns short URL parameters of edit request,
+// only fields which are present in the request are changed.
+func (er *editRequest) params() (*trim.ReqParams, error) {
+	params := &trim.ReqParams{IsAPI: true}
+	if er.URL != nil {
+		params.Original, params.Fields = *er.URL, params.Fields|trim.FieldURL
+	}
+	if er.Tag != nil {
+		params.Tag, params.Fields = *er.Tag, params.Fields|trim.FieldTag
+	}
+	if er.Group != nil {
+		params.Group, params.Fields = *er.Group, params.Fields|trim.FieldGroup
+	}
+	if er.TTL != nil || er.Expire != nil {
+		var (
+			ttl    uint64
+			expire string
+		)
+		if er.TTL != nil {
+			ttl = *er.TTL
+		}
+		if er.Expire != nil {
+			expire = *er.Expire
+		}
+		t, err := trim.ExpireTime(ttl, expire)
+		if err != nil {
+			return nil, err
+		}
+		// zero values remove expiration time
+		params.TTL, params.Fields = t, params.Fields|trim.FieldTTL
+	}
+	if er.Clicks != nil {
+		params.MaxClicks, params.Fields = *er.Clicks, params.Fields|trim.FieldClicks
+	}
+	if er.Password != nil {
+		params.Password, params.Fields = *er.Password, params.Fields|trim.FieldPassword
+	}
+	if er.NotDirect != nil {
+		params.NotDirect, params.Fields = *er.NotDirect, params.Fields|trim.FieldNotDirect
+	}
+	if er.Targets != nil {
+		params.Targets, params.Fields = targetParams(*er.Targets), params.Fields|trim.FieldTargets
+	}
+	if er.Sticky != nil {
+		params.Sticky, params.Fields = *er.Sticky, params.Fields|trim.FieldSticky
+	}
+	if er.Geo != nil {
+		params.Geo, params.Fields = geoParams(*er.Geo), params.Fields|trim.FieldGeo
+	}
+	if er.Devices != nil {
+		params.Devices, params.Fields = *er.Devices, params.Fields|trim.FieldDevices
+	}
+	if er.Query != nil {
+		params.Query, params.Fields = *er.Query, params.Fields|trim.FieldQuery
+	}
+	if er.Suffix != nil {
+		params.Suffix, params.Fields = *er.Suffix, params.Fields|trim.FieldSuffix
+	}
+	if er.Code != nil {
+		params.Code, params.Fields = *er.Code, params.Fields|trim.FieldCode
+	}
+	if er.Cb != nil {
+		params.Cb = trim.CallBack{
+			URL:    er.Cb.URL,
+			Method: er.Cb.Method,
+			Name:   er.Cb.Name,
+			Value:  er.Cb.Value,
+		}
+		params.Fields |= trim.FieldCb
+	}
+	if params.Fields == 0 {
+		return nil, errors.New("empty request parameters")
+	}
+	return params, nil
+}
+
+// HandlerEdit changes existing short URLs.
+func HandlerEdit(ctx context.Context, w http.ResponseWriter, r *http.Request) core.ErrHandler {
+	c, err := conf.FromContext(ctx)
+	if err != nil {
+		return core.ErrHandler{Err: err, Status: http.StatusInternalServerError}
+	}
+	defer r.Body.Close()
+	shorts, links, err := validateEditParams(r)
+	if err != nil {
+		if err == ErrEmptyRequest {
+			return core.ErrHandler{Err: err, Status: http.StatusNoContent}
+		}
+		return core.ErrHandler{Err: err, Status: http.StatusBadRequest}
+	}
+	cus, err := trim.Edit(ctx, shorts, links)
+	if err != nil {
+		return core.ErrHandler{Err: err, Status: http.StatusInternalServerError}
+	}
+	user, err := auth.ExtractUser(ctx)
+	if err != nil {
+		return core.ErrHandler{Err: err, Status: http.StatusInternalServerError}
+	}
+	items := getItems(c, user, cus)
+	result := &addResponse{
+		Err:    0,
+		Msg:    "ok",
+		Result: items,
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		return core.ErrHandler{Err: err, Status: http.StatusInternalServerError}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", b)
+	return core.ErrHandler{Err: nil, Status: http.StatusOK}
+}
+
+// handlerState changes a state of short URLs using the fn.
+func handlerState(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	fn func(ctx context.Context, links []string) ([]trim.ChangeResult, error)) core.ErrHandler {
 	var grs []getRequest
 	c, err := conf.FromContext(ctx)
 	if err != nil {
@@ -308,20 +603,111 @@ func HandlerGet(ctx context.Context, w http.ResponseWriter, r *http.Request) cor
 	if len(links) == 0 {
 		return core.ErrHandler{Err: ErrEmptyRequest, Status: http.StatusNoContent}
 	}
-	cus, err := trim.MultiLengthen(ctx, links)
+	cus, err := fn(ctx, links)
 	if err != nil {
 		return core.ErrHandler{Err: err, Status: http.StatusInternalServerError}
 	}
+	user, err := auth.ExtractUser(ctx)
+	if err != nil {
+		return core.ErrHandler{Err: err, Status: http.StatusInternalServerError}
+	}
+	items := getItems(c, user, cus)
+	result := &addResponse{
+		Err:    0,
+		Msg:    "ok",
+		Result: items,
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		return core.ErrHandler{Err: err, Status: http.StatusInternalServerError}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", b)
+	return core.ErrHandler{Err: nil, Status: http.StatusOK}
+}
+
+// HandlerDisable deactivates short URLs.
+func HandlerDisable(ctx context.Context, w http.ResponseWriter, r *http.Request) core.ErrHandler {
+	return handlerState(ctx, w, r, trim.Disable)
+}
+
+// HandlerEnable activates short URLs.
+func HandlerEnable(ctx context.Context, w http.ResponseWriter, r *http.Request) core.ErrHandler {
+	return handlerState(ctx, w, r, trim.Enable)
+}
+
+// HandlerDelete moves short URLs to trash.
+func HandlerDelete(ctx context.Context, w http.ResponseWriter, r *http.Request) core.ErrHandler {
+	return handlerState(ctx, w, r, trim.Delete)
+}
+
+// canRead returns true if the user can read destinations of the short URL,
+// protected ones are available only for their owners and administrators.
+func canRead(user *auth.User, cu *trim.CustomURL) bool {
+	if !cu.Protected() || user.HasRole("admin") {
+		return true
+	}
+	return !user.IsAnonymous() && user.Name == cu.User
+}
+
+// getItems returns response items of get request.
+func getItems(c *conf.Config, user *auth.User, cus []trim.ChangeResult) []addResponseItem {
 	items := make([]addResponseItem, len(cus))
 	for i, cu := range cus {
 		id := cu.Cu.String()
-		items[i] = addResponseItem{
-			ID:       id,
-			Short:    c.Address(id),
-			Original: cu.Cu.Original,
-			Err:      cu.Err,
+		items[i] = addResponseItem{ID: id, Short: c.Address(id), Err: cu.Err}
+		if cu.Err != "" || !canRead(user, cu.Cu) {
+			continue
 		}
+		items[i].Original = cu.Cu.Original
+		items[i].Targets = targetItems(cu.Cu.Targets)
+		items[i].Geo = geoItems(cu.Cu.Geo)
+		items[i].Devices = cu.Cu.Devices
+		items[i].Query = cu.Cu.Query
+		items[i].Suffix = cu.Cu.Suffix
+		items[i].Code = cu.Cu.Code
+		items[i].Health = newHealthResponse(cu.Cu)
+	}
+	return items
+}
+
+// HandlerGet returns info about short URLs, destinations of
+// protected ones are hidden from other users.
+func HandlerGet(ctx context.Context, w http.ResponseWriter, r *http.Request) core.ErrHandler {
+	var grs []getRequest
+	c, err := conf.FromContext(ctx)
+	if err != nil {
+		return core.ErrHandler{Err: err, Status: http.StatusInternalServerError}
+	}
+	defer r.Body.Close()
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&grs)
+	if (err != nil) && (err != io.EOF) {
+		return core.ErrHandler{Err: err, Status: http.StatusBadRequest}
+	}
+	links := []string{}
+	for i := range grs {
+		link, err := core.TrimAddress(grs[i].Short)
+		if err != nil {
+			c.L.Debug.Printf("invalid short URL [%v] was skipped: %v", link, err)
+			continue
+		}
+		if l, ok := trim.IsShort(link); ok {
+			links = append(links, l)
+		}
+	}
+	if len(links) == 0 {
+		return core.ErrHandler{Err: ErrEmptyRequest, Status: http.StatusNoContent}
+	}
+	cus, err := trim.MultiLengthen(ctx, links)
+	if err != nil {
+		return core.ErrHandler{Err: err, Status: http.StatusInternalServerError}
+	}
+	user, err := auth.ExtractUser(ctx)
+	if err != nil {
+		return core.ErrHandler{Err: err, Status: http.StatusInternalServerError}
 	}
+	items := getItems(c, user, cus)
 	result := &addResponse{
 		Err:    0,
 		Msg:    "ok",
@@ -540,8 +926,8 @@ func HandlerImport(ctx context.Context, w http.ResponseWriter, r *http.Request)
 	if n == 0 {
 		return core.ErrHandler{Err: ErrEmptyRequest, Status: http.StatusNoContent}
 	}
-	links := make(map[string]*trim.ReqParams, n)
-	for _, impr := range imprs {
+	shorts, links := make([]string, n), make([]*trim.ReqParams, n)
+	for i, impr := range imprs {
 		params := &trim.ReqParams{
 			Original:  impr.Original,
 			Tag:       "",
@@ -555,16 +941,16 @@ func HandlerImport(ctx context.Context, w http.ResponseWriter, r *http.Request)
 		if err != nil {
 			return core.ErrHandler{Err: err, Status: http.StatusBadRequest}
 		}
-		links[impr.Short] = params
+		shorts[i], links[i] = impr.Short, params
 	}
-	cus, err := trim.Import(ctx, links)
+	cus, err := trim.Import(ctx, shorts, links)
 	if err != nil {
 		return core.ErrHandler{Err: err, Status: http.StatusInternalServerError}
 	}
 	items := make([]importResponseItem, len(cus))
 	for i, cu := range cus {
 		if cu.Err != "" {
-			items[i] = importResponseItem{Err: cu.Err}
+			items[i] = importResponseItem{Short: shorts[i], Err: cu.Err}
 		} else {
 			items[i] = importResponseItem{Short: cu.Cu.String()}
 		}
@@ -634,6 +1020,13 @@ func HandlerExport(ctx context.Context, w http.ResponseWriter, r *http.Request)
 			Group:    cu.Group,
 			Tag:      cu.Tag,
 			Created:  cu.Created.UTC().Format(layout),
+			Targets:  targetItems(cu.Targets),
+			Geo:      geoItems(cu.Geo),
+			Devices:  cu.Devices,
+			Query:    cu.Query,
+			Suffix:   cu.Suffix,
+			Code:     cu.Code,
+			Health:   newHealthResponse(cu),
 		}
 	}
 	result := &exportResponse{
@@ -3,3 +3,65 @@
 // license that can be found in the LICENSE file.
 
 package api
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/z0rr0/luss/auth"
+	"github.com/z0rr0/luss/conf"
+	"github.com/z0rr0/luss/trim"
+)
+
+func TestGetItems(t *testing.T) {
+	const original = "http://secret.example.com/"
+	c := &conf.Config{}
+	c.Domain.Name = "lu.ss"
+	cus := []trim.ChangeResult{
+		{Cu: &trim.CustomURL{ID: 1, User: "owner", Original: original, Password: "hash",
+			Targets: []trim.Target{{URL: original + "a", Weight: 1}}}},
+	}
+	suite := []struct {
+		user *auth.User
+		ok   bool
+	}{
+		{auth.AnonUser, false},
+		{&auth.User{Name: "other"}, false},
+		{&auth.User{Name: "owner"}, true},
+		{&auth.User{Name: "root", Roles: []string{"admin"}}, true},
+	}
+	for i, v := range suite {
+		b, err := json.Marshal(getItems(c, v.user, cus))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(b), original) != v.ok {
+			t.Errorf("incorrect behavior [%v]: %s", i, b)
+		}
+	}
+	cus[0].Cu.Password = ""
+	if items := getItems(c, auth.AnonUser, cus); items[0].Original != original {
+		t.Errorf("incorrect behavior: %v", items[0])
+	}
+}
+
+func TestEditParams(t *testing.T) {
+	var er editRequest
+	if err := json.Unmarshal([]byte(`{"short": "b", "tag": "", "targets": [], "ttl": 0}`), &er); err != nil {
+		t.Fatal(err)
+	}
+	params, err := er.params()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.Fields != trim.FieldTag|trim.FieldTargets|trim.FieldTTL || params.TTL != nil {
+		t.Errorf("invalid behavior: %v", params.Fields)
+	}
+	if err := params.Valid(); err != nil {
+		t.Errorf("invalid behavior: %v", err)
+	}
+	if _, err := (&editRequest{Short: "b"}).params(); err == nil {
+		t.Error("invalid behavior")
+	}
+}
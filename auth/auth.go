@@ -17,8 +17,6 @@ import (
 	"github.com/z0rr0/luss/conf"
 	"github.com/z0rr0/luss/db"
 	"golang.org/x/crypto/sha3"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
 )
 
 const (
@@ -102,16 +100,12 @@ func tokenHash(b []byte, c *conf.Config) []byte {
 }
 
 // InitUsers initializes admin and anonymous users.
-func InitUsers(c *conf.Config) error {
-	s, err := db.NewSession(c.Conn, false)
-	if err != nil {
-		return err
-	}
-	defer s.Close()
-	coll, err := db.Coll(s, "users")
+func InitUsers(ctx context.Context, c *conf.Config) error {
+	st, err := db.NewStorage(c, false)
 	if err != nil {
 		return err
 	}
+	defer st.Close()
 	b, err := hex.DecodeString(c.Listener.Security.Admin)
 	if err != nil {
 		return err
@@ -137,8 +131,8 @@ func InitUsers(c *conf.Config) error {
 		},
 	}
 	for _, u := range users {
-		err := coll.Insert(u)
-		if err != nil && !mgo.IsDup(err) {
+		err := st.InsertUser(ctx, u)
+		if err != nil && err != db.ErrDuplicate {
 			return err
 		}
 	}
@@ -239,13 +233,13 @@ func Authenticate(ctx context.Context) (context.Context, error) {
 		// it is anonymous request
 		return setUserContext(ctx, AnonUser), nil
 	}
-	// use already opened session from context
-	coll, err := db.C(ctx, "users")
+	// use already opened storage from context
+	st, err := db.CtxStorage(ctx)
 	if err != nil {
 		return ctx, err
 	}
 	u := &User{}
-	err = coll.Find(bson.M{"token": t, "off": false}).One(u)
+	err = st.FindUser(ctx, t, u)
 	if err != nil {
 		return ctx, err
 	}
@@ -255,21 +249,17 @@ func Authenticate(ctx context.Context) (context.Context, error) {
 // DisableUsers deactivates users' accounts.
 // Administrator permissions should be checked before this call.
 func DisableUsers(ctx context.Context, names []string) ([]UserResult, error) {
-	s, err := db.CtxSession(ctx)
-	if err != nil {
-		return nil, err
-	}
-	coll, err := db.Coll(s, "users")
+	st, err := db.CtxStorage(ctx)
 	if err != nil {
 		return nil, err
 	}
 	now := time.Now().UTC()
 	result := make([]UserResult, len(names))
 	for i, name := range names {
-		err = coll.Update(bson.M{"_id": name, "off": false}, bson.M{"$set": bson.M{"off": true, "mt": now}})
+		err = st.DisableUser(ctx, name, now)
 		if err != nil {
 			errMsg := "internal error"
-			if err == mgo.ErrNotFound {
+			if err == db.ErrNotFound {
 				errMsg = "not found"
 			}
 			result[i] = UserResult{Name: name, Err: errMsg}
@@ -291,11 +281,7 @@ func ChangeUsers(ctx context.Context, names []string) ([]UserResult, error) {
 	if err != nil {
 		return nil, err
 	}
-	s, err := db.CtxSession(ctx)
-	if err != nil {
-		return nil, err
-	}
-	coll, err := db.Coll(s, "users")
+	st, err := db.CtxStorage(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -312,10 +298,10 @@ func ChangeUsers(ctx context.Context, names []string) ([]UserResult, error) {
 			result[i] = UserResult{Name: name, U: nil, Err: "internal error"}
 			continue
 		}
-		err = coll.UpdateId(name, bson.M{"$set": bson.M{"token": hash, "mt": now}})
+		err = st.UpdateToken(ctx, name, hash, now)
 		if err != nil {
 			errMsg := "internal error"
-			if err == mgo.ErrNotFound {
+			if err == db.ErrNotFound {
 				errMsg = "not found"
 			}
 			result[i] = UserResult{Name: name, U: nil, Err: errMsg}
@@ -332,11 +318,7 @@ func CreateUsers(ctx context.Context, names []string) ([]UserResult, error) {
 	if err != nil {
 		return nil, err
 	}
-	s, err := db.CtxSession(ctx)
-	if err != nil {
-		return nil, err
-	}
-	coll, err := db.Coll(s, "users")
+	st, err := db.CtxStorage(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -355,8 +337,8 @@ func CreateUsers(ctx context.Context, names []string) ([]UserResult, error) {
 			Modified: now,
 			Created:  now,
 		}
-		if err := coll.Insert(user); err != nil {
-			if mgo.IsDup(err) {
+		if err := st.InsertUser(ctx, user); err != nil {
+			if err == db.ErrDuplicate {
 				result[i] = UserResult{Name: name, U: nil, Err: "duplicate item"}
 			} else {
 				result[i] = UserResult{Name: name, U: nil, Err: "internal error"}
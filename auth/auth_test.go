@@ -13,6 +13,7 @@ import (
 	"github.com/z0rr0/luss/conf"
 	"github.com/z0rr0/luss/db"
 	"github.com/z0rr0/luss/test"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 func TestEqualBytes(t *testing.T) {
@@ -119,26 +120,26 @@ func TestCreateUser(t *testing.T) {
 	ctx, cancel := context.WithCancel(conf.NewContext(cfg))
 	defer cancel()
 
-	s, err := db.NewSession(cfg.Conn, true)
+	m, err := db.NewMongo(cfg.Conn, true)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer s.Close()
-	ctx = db.NewContext(ctx, s)
+	defer m.Close()
+	ctx = db.NewContext(ctx, m)
 
-	coll, err := db.Coll(s, "users")
+	coll, err := db.Coll(m.DB, "users")
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = coll.RemoveAll(nil)
+	_, err = coll.DeleteMany(ctx, bson.M{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = InitUsers(cfg)
+	err = InitUsers(ctx, cfg)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if n, err := coll.Count(); err != nil || n != 2 {
+	if n, err := coll.CountDocuments(ctx, bson.M{}); err != nil || n != 2 {
 		t.Errorf("n=%v, err=%v", n, err)
 	}
 
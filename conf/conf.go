@@ -21,19 +21,39 @@ import (
 	"strings"
 	"sync"
 	"text/template"
+	"time"
 
 	"github.com/hashicorp/golang-lru"
 	"github.com/oschwald/geoip2-golang"
-	"gopkg.in/mgo.v2"
+	"github.com/z0rr0/luss/device"
+	"github.com/z0rr0/luss/policy"
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 const (
+	// MongoEngine is MongoDB storage engine name, it is used by default.
+	MongoEngine = "mongodb"
+	// BoltEngine is embedded single-file storage engine name.
+	BoltEngine = "bolt"
 	// saltLent in minimal recommended salt length.
 	saltLent = 16
 	// configKey is internal context key
 	configKey key = 0
 	// mmDB is geo IP database URL.
 	mmDB = "http://geolite.maxmind.com/download/geoip/database/GeoLite2-City.mmdb.gz"
+	// defaultPwdLimit is default number of password attempts per minute.
+	defaultPwdLimit = 5
+	// minRandLen, maxRandLen and defaultRandLen are limits of random short URLs length,
+	// random identifiers don't intersect with sequential ones.
+	minRandLen, maxRandLen, defaultRandLen = 7, 10, 8
+	// defaultIDBlock is default size of short URLs identifiers block.
+	defaultIDBlock = 100
+	// defaultLockTTL is default lease time of distributed locks (seconds).
+	defaultLockTTL = 60
+	// defaultRedirect is default HTTP status code of redirects.
+	defaultRedirect = http.StatusFound
 )
 
 var (
@@ -46,9 +66,11 @@ type key int
 
 // Conn is database connection structure.
 type Conn struct {
-	S   *mgo.Session
-	M   sync.Mutex
-	Cfg *MongoCfg
+	C       *mongo.Client
+	B       *bbolt.DB
+	M       sync.Mutex
+	Cfg     *MongoCfg
+	Storage *StorageCfg
 }
 
 // domain is settings if main service domain.
@@ -76,20 +98,49 @@ type listener struct {
 
 // settings is a struct for different settings.
 type settings struct {
-	MaxSpam    int    `json:"maxspam"`
-	CleanMin   int64  `json:"cleanup"`
-	CbAllow    bool   `json:"cballow"`
-	CbNum      int    `json:"cbnum"`
-	CbBuf      int    `json:"cbbuf"`
-	CbLength   int    `json:"cblength"`
-	MaxName    int    `json:"maxname"`
-	Anonymous  bool   `json:"anonymous"`
-	MaxPack    int    `json:"maxpack"`
-	Trackers   int    `json:"trackers"`
-	GeoIPDB    string `json:"geoipdb"`
-	MaxReqSize int64  `json:"maxreqsize"`
-	TrackOn    bool   `json:"trackon"`
-	TrackProxy string `json:"trackproxy"`
+	MaxSpam      int      `json:"maxspam"`
+	CleanMin     int64    `json:"cleanup"`
+	CbAllow      bool     `json:"cballow"`
+	CbNum        int      `json:"cbnum"`
+	CbBuf        int      `json:"cbbuf"`
+	CbLength     int      `json:"cblength"`
+	MaxName      int      `json:"maxname"`
+	Anonymous    bool     `json:"anonymous"`
+	MaxPack      int      `json:"maxpack"`
+	Trackers     int      `json:"trackers"`
+	GeoIPDB      string   `json:"geoipdb"`
+	MaxReqSize   int64    `json:"maxreqsize"`
+	TrackOn      bool     `json:"trackon"`
+	TrackProxy   string   `json:"trackproxy"`
+	Node         string   `json:"node"`
+	IDBlock      int      `json:"idblock"`
+	LockTTL      int64    `json:"lockttl"`
+	Retention    int      `json:"retention"`
+	RollupMin    int64    `json:"rollup"`
+	RollArch     bool     `json:"rollarchive"`
+	Random       bool     `json:"random"`
+	RandGroups   []string `json:"randgroups"`
+	RandLen      int      `json:"randlen"`
+	Dedup        bool     `json:"dedup"`
+	Trash        int      `json:"trash"`
+	Countdown    int      `json:"countdown"`
+	PwdLimit     int      `json:"pwdlimit"`
+	SpamLists    []string `json:"spamlists"`
+	SpamCheck    int64    `json:"spamcheck"`
+	SpamAction   string   `json:"spamaction"`
+	HealthCheck  int64    `json:"healthcheck"`
+	HealthNum    int      `json:"healthnum"`
+	HealthFails  int      `json:"healthfails"`
+	HealthAction string   `json:"healthaction"`
+	QueryWins    string   `json:"querywins"`
+	Redirect     int      `json:"redirect"`
+	CacheAge     int64    `json:"cacheage"`
+}
+
+// policies is destination URLs policy, groups' policies replace the common one.
+type policies struct {
+	policy.Policy
+	Groups map[string]*policy.Policy `json:"groups"`
 }
 
 // MongoCfg is database configuration settings
@@ -108,10 +159,17 @@ type MongoCfg struct {
 	RcnTime    int64    `json:"rcntime"`
 	PoolLimit  int      `json:"poollimit"`
 	Debug      bool     `json:"debug"`
-	MongoCred  *mgo.DialInfo
+	MongoCred  *options.ClientOptions
 	Logger     *log.Logger
 }
 
+// StorageCfg is data storage settings.
+type StorageCfg struct {
+	Engine  string `json:"engine"`
+	File    string `json:"file"`
+	Timeout uint   `json:"timeout"`
+}
+
 // cache is database connections pool settings
 type cache struct {
 	URLs      int `json:"urls"`
@@ -128,15 +186,19 @@ type Logger struct {
 
 // Config is main configuration storage.
 type Config struct {
-	Domain   domain   `json:"domain"`
-	Listener listener `json:"listener"`
-	Settings settings `json:"settings"`
-	Db       MongoCfg `json:"database"`
-	Cache    cache    `json:"cache"`
-	Debug    bool     `json:"debug"`
-	Conn     *Conn
-	GeoDB    *geoip2.Reader
-	L        Logger
+	Domain    domain                   `json:"domain"`
+	Listener  listener                 `json:"listener"`
+	Settings  settings                 `json:"settings"`
+	Db        MongoCfg                 `json:"database"`
+	Storage   StorageCfg               `json:"storage"`
+	Cache     cache                    `json:"cache"`
+	Policy    policies                 `json:"policy"`
+	Devices   map[string][]device.Rule `json:"devices"`
+	Redirects map[string]int           `json:"redirects"`
+	Debug     bool                     `json:"debug"`
+	Conn      *Conn
+	GeoDB     *geoip2.Reader
+	L         Logger
 }
 
 // downloadGeoIPDB downloads MM Geo IP database.
@@ -166,8 +228,11 @@ func downloadGeoIPDB(name string) (int64, error) {
 func (c *Conn) Close() {
 	c.M.Lock()
 	defer c.M.Unlock()
-	if c.S != nil {
-		c.S.Close()
+	if c.C != nil {
+		c.C.Disconnect(context.Background())
+	}
+	if c.B != nil {
+		c.B.Close()
 	}
 }
 
@@ -181,6 +246,92 @@ func (c *Config) Close() {
 	}
 }
 
+// RandomCodes returns true if random short URLs should be used for the group.
+func (c *Config) RandomCodes(group string) bool {
+	if c.Settings.Random {
+		return true
+	}
+	for _, g := range c.Settings.RandGroups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// RandomLen returns a length of random short URLs.
+func (c *Config) RandomLen() int {
+	if c.Settings.RandLen == 0 {
+		return defaultRandLen
+	}
+	return c.Settings.RandLen
+}
+
+// PasswordLimit returns max number of password attempts per minute
+// for one client and short URL.
+func (c *Config) PasswordLimit() int {
+	if c.Settings.PwdLimit == 0 {
+		return defaultPwdLimit
+	}
+	return c.Settings.PwdLimit
+}
+
+// URLPolicy returns destination URLs policy of the group.
+func (c *Config) URLPolicy(group string) *policy.Policy {
+	if p, ok := c.Policy.Groups[group]; ok {
+		return p
+	}
+	return &c.Policy.Policy
+}
+
+// GroupDevices returns device rules of the group,
+// they are used for short URLs without own rules.
+func (c *Config) GroupDevices(group string) []device.Rule {
+	return c.Devices[group]
+}
+
+// ValidRedirect checks HTTP status code can be used for redirects.
+func ValidRedirect(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// RedirectCode returns HTTP status code of the group's redirects,
+// it's used for short URLs without own code.
+func (c *Config) RedirectCode(group string) int {
+	if code, ok := c.Redirects[group]; ok {
+		return code
+	}
+	if c.Settings.Redirect == 0 {
+		return defaultRedirect
+	}
+	return c.Settings.Redirect
+}
+
+// CacheAge returns max age of cached permanent redirects.
+func (c *Config) CacheAge() time.Duration {
+	return time.Duration(c.Settings.CacheAge) * time.Second
+}
+
+// IDBlock returns a size of short URLs identifiers block leased by the node.
+func (c *Config) IDBlock() int {
+	if c.Settings.IDBlock == 0 {
+		return defaultIDBlock
+	}
+	return c.Settings.IDBlock
+}
+
+// LockTTL returns a lease time of distributed locks.
+func (c *Config) LockTTL() time.Duration {
+	if c.Settings.LockTTL == 0 {
+		return defaultLockTTL * time.Second
+	}
+	return time.Duration(c.Settings.LockTTL) * time.Second
+}
+
 // Address returns a full URL address.
 func (c *Config) Address(uri string) string {
 	domain := c.Domain.Name
@@ -232,6 +383,77 @@ func (c *Config) checkGeoIPDB() error {
 	return nil
 }
 
+// checkNode sets host name as a default node name.
+func (c *Config) checkNode() error {
+	if c.Settings.Node != "" {
+		return nil
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	c.Settings.Node = name
+	return nil
+}
+
+// checkStorage validates data storage settings and sets default engine.
+func (c *Config) checkStorage() error {
+	switch c.Storage.Engine {
+	case "":
+		c.Storage.Engine = MongoEngine
+	case MongoEngine:
+		// default engine
+	case BoltEngine:
+		if c.Storage.File == "" {
+			return errors.New("empty storage file name")
+		}
+		fullpath, err := filepath.Abs(c.Storage.File)
+		if err != nil {
+			return err
+		}
+		c.Storage.File = fullpath
+	default:
+		return fmt.Errorf("unknown storage engine: %v", c.Storage.Engine)
+	}
+	return nil
+}
+
+// checkPolicy validates and prepares destination URLs policies.
+func (c *Config) checkPolicy() error {
+	if err := c.Policy.Init(); err != nil {
+		return err
+	}
+	for group, p := range c.Policy.Groups {
+		if p == nil {
+			return fmt.Errorf("empty policy of group %q", group)
+		}
+		if err := p.Init(); err != nil {
+			return fmt.Errorf("group %q: %v", group, err)
+		}
+	}
+	return nil
+}
+
+// checkDevices validates groups' device rules.
+func (c *Config) checkDevices() error {
+	for group, rules := range c.Devices {
+		if err := device.Check(rules); err != nil {
+			return fmt.Errorf("group %q: %v", group, err)
+		}
+	}
+	return nil
+}
+
+// checkRedirects validates groups' redirect codes.
+func (c *Config) checkRedirects() error {
+	for group, code := range c.Redirects {
+		if !ValidRedirect(code) {
+			return fmt.Errorf("group %q: unknown redirect code %v", group, code)
+		}
+	}
+	return nil
+}
+
 // Validate validates configuration settings.
 func (c *Config) Validate() error {
 	var err error
@@ -250,8 +472,8 @@ func (c *Config) Validate() error {
 		err = errFunc("incorrect or empty value", "listener.security.tokenlen")
 	case len(c.Listener.Security.Salt) < saltLent:
 		err = errFunc(fmt.Sprintf("insecure salt value, min length is %v symbols", saltLent), "listener.security.salt")
-	case c.Settings.MaxSpam < 1:
-		err = errFunc("incorrect or empty value", "settings.maxspam")
+	case c.Settings.MaxSpam < 1 || c.Settings.MaxSpam > 100:
+		err = errFunc("incorrect or empty value, it should be in [1, 100]", "settings.maxspam")
 	case c.Settings.CleanMin < 1:
 		err = errFunc("incorrect or empty value", "settings.cleanup")
 	case c.Settings.CbNum < 1:
@@ -268,18 +490,63 @@ func (c *Config) Validate() error {
 		err = errFunc("incorrect or empty value", "settings.maxreqsize")
 	case c.Settings.Trackers < 1:
 		err = errFunc("incorrect or empty value", "settings.trackers")
+	case c.Settings.IDBlock < 0:
+		err = errFunc("incorrect value", "settings.idblock")
+	case c.Settings.LockTTL < 0:
+		err = errFunc("incorrect value", "settings.lockttl")
+	case c.Settings.Retention < 0:
+		err = errFunc("incorrect value", "settings.retention")
+	case c.Settings.Retention > 0 && c.Settings.RollupMin < 1:
+		err = errFunc("incorrect or empty value", "settings.rollup")
+	case c.Settings.Trash < 0:
+		err = errFunc("incorrect value", "settings.trash")
+	case c.Settings.Countdown < 0:
+		err = errFunc("incorrect value", "settings.countdown")
+	case c.Settings.PwdLimit < 0:
+		err = errFunc("incorrect value", "settings.pwdlimit")
+	case c.Settings.SpamCheck < 0:
+		err = errFunc("incorrect value", "settings.spamcheck")
+	case c.Settings.SpamAction != "" && c.Settings.SpamAction != "disable" && c.Settings.SpamAction != "preview":
+		err = errFunc("unknown action", "settings.spamaction")
+	case c.Settings.HealthCheck < 0:
+		err = errFunc("incorrect value", "settings.healthcheck")
+	case c.Settings.HealthCheck > 0 && c.Settings.HealthNum < 1:
+		err = errFunc("incorrect or empty value", "settings.healthnum")
+	case c.Settings.HealthCheck > 0 && c.Settings.HealthFails < 1:
+		err = errFunc("incorrect or empty value", "settings.healthfails")
+	case c.Settings.HealthAction != "" && c.Settings.HealthAction != "flag" &&
+		c.Settings.HealthAction != "disable" && c.Settings.HealthAction != "notify":
+		err = errFunc("unknown action", "settings.healthaction")
+	case c.Settings.QueryWins != "" && c.Settings.QueryWins != "link" && c.Settings.QueryWins != "request":
+		err = errFunc("unknown precedence", "settings.querywins")
+	case c.Settings.Redirect != 0 && !ValidRedirect(c.Settings.Redirect):
+		err = errFunc("unknown redirect code", "settings.redirect")
+	case c.Settings.CacheAge < 0:
+		err = errFunc("negative value", "settings.cacheage")
+	case c.Settings.RandLen != 0 && (c.Settings.RandLen < minRandLen || c.Settings.RandLen > maxRandLen):
+		err = errFunc(fmt.Sprintf("value should be in range [%v, %v]", minRandLen, maxRandLen), "settings.randlen")
+	case c.checkNode() != nil:
+		err = errFunc("can not detect host name", "settings.node")
 	case c.checkTemplates() != nil:
 		err = errFunc("invalid template name", "listener.templates")
 	case c.Cache.URLs < 0:
 		err = errFunc("incorrect value", "cache.urls")
 	case c.Cache.Templates < 0:
 		err = errFunc("incorrect value", "cache.templates")
+	case c.checkStorage() != nil:
+		err = errFunc("unknown engine or empty file name", "storage")
+	case c.checkPolicy() != nil:
+		err = errFunc("invalid scheme, host pattern or network", "policy")
+	case c.checkDevices() != nil:
+		err = errFunc("unknown platform or empty URL", "devices")
+	case c.checkRedirects() != nil:
+		err = errFunc("unknown redirect code", "redirects")
 	}
 	if err != nil {
 		return err
 	}
 	// db connection check is skipped here
-	c.Conn = &Conn{Cfg: &c.Db}
+	c.Conn = &Conn{Cfg: &c.Db, Storage: &c.Storage}
 	// caching enabling
 	err = c.allocateLRU()
 	if err != nil {
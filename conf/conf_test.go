@@ -5,9 +5,12 @@
 package conf
 
 import (
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/z0rr0/luss/device"
+	"github.com/z0rr0/luss/policy"
 	"github.com/z0rr0/luss/test"
 )
 
@@ -73,6 +76,10 @@ func TestParseConfig(t *testing.T) {
 	if err := cfg.Validate(); err == nil {
 		t.Errorf("incorrect behavior")
 	}
+	cfg.Settings.MaxSpam = 101
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("incorrect behavior")
+	}
 	cfg.Settings.MaxSpam = oldMaxSpam
 
 	oldCleanMin := cfg.Settings.CleanMin
@@ -131,6 +138,162 @@ func TestParseConfig(t *testing.T) {
 	}
 	cfg.Settings.Trackers = oldTrackers
 
+	oldIDBlock := cfg.Settings.IDBlock
+	cfg.Settings.IDBlock = -1
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("incorrect behavior")
+	}
+	cfg.Settings.IDBlock = 0
+	if err := cfg.Validate(); err != nil || cfg.IDBlock() < 1 {
+		t.Errorf("incorrect behavior: %v", err)
+	}
+	cfg.Settings.IDBlock = oldIDBlock
+
+	oldLockTTL := cfg.Settings.LockTTL
+	cfg.Settings.LockTTL = -1
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("incorrect behavior")
+	}
+	cfg.Settings.LockTTL = 0
+	if err := cfg.Validate(); err != nil || cfg.LockTTL() <= 0 {
+		t.Errorf("incorrect behavior: %v", err)
+	}
+	cfg.Settings.LockTTL = oldLockTTL
+
+	oldRetention, oldRollupMin := cfg.Settings.Retention, cfg.Settings.RollupMin
+	cfg.Settings.Retention = -1
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("incorrect behavior")
+	}
+	cfg.Settings.Retention, cfg.Settings.RollupMin = 1, 0
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("incorrect behavior")
+	}
+	cfg.Settings.Retention, cfg.Settings.RollupMin = oldRetention, oldRollupMin
+
+	oldSpamAction := cfg.Settings.SpamAction
+	cfg.Settings.SpamAction = "unknown"
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("incorrect behavior")
+	}
+	cfg.Settings.SpamAction = oldSpamAction
+
+	oldHealthCheck, oldHealthNum := cfg.Settings.HealthCheck, cfg.Settings.HealthNum
+	cfg.Settings.HealthCheck = -1
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("incorrect behavior")
+	}
+	cfg.Settings.HealthCheck, cfg.Settings.HealthNum = 60, 0
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("incorrect behavior")
+	}
+	cfg.Settings.HealthCheck, cfg.Settings.HealthNum = oldHealthCheck, oldHealthNum
+
+	oldHealthAction := cfg.Settings.HealthAction
+	cfg.Settings.HealthAction = "unknown"
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("incorrect behavior")
+	}
+	cfg.Settings.HealthAction = oldHealthAction
+
+	oldQueryWins := cfg.Settings.QueryWins
+	cfg.Settings.QueryWins = "unknown"
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("incorrect behavior")
+	}
+	cfg.Settings.QueryWins = oldQueryWins
+
+	oldRedirect := cfg.Settings.Redirect
+	cfg.Settings.Redirect = 303
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("incorrect behavior")
+	}
+	cfg.Settings.Redirect = oldRedirect
+
+	oldCacheAge := cfg.Settings.CacheAge
+	cfg.Settings.CacheAge = -1
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("incorrect behavior")
+	}
+	cfg.Settings.CacheAge = oldCacheAge
+
+	oldTrash := cfg.Settings.Trash
+	cfg.Settings.Trash = -1
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("incorrect behavior")
+	}
+	cfg.Settings.Trash = oldTrash
+
+	oldRandLen := cfg.Settings.RandLen
+	for _, v := range []int{-1, 6, 11} {
+		cfg.Settings.RandLen = v
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("incorrect behavior: %v", v)
+		}
+	}
+	cfg.Settings.RandLen = oldRandLen
+	if n := cfg.RandomLen(); n < 7 || n > 10 {
+		t.Errorf("incorrect behavior: %v", n)
+	}
+
+	oldDeny := cfg.Policy.Deny
+	cfg.Policy.Deny = []string{"10.0.0.0/33"}
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("incorrect behavior")
+	}
+	cfg.Policy.Deny = oldDeny
+
+	oldGroups := cfg.Policy.Groups
+	cfg.Policy.Groups = map[string]*policy.Policy{"g": {Schemes: []string{""}}}
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("incorrect behavior")
+	}
+	cfg.Policy.Groups = map[string]*policy.Policy{"g": {Schemes: []string{"https"}}}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("incorrect behavior: %v", err)
+	}
+	if p := cfg.URLPolicy("g"); len(p.Schemes) != 1 || p.Schemes[0] != "https" {
+		t.Errorf("incorrect behavior: %v", p.Schemes)
+	}
+	if p := cfg.URLPolicy("other"); p != &cfg.Policy.Policy {
+		t.Errorf("incorrect behavior")
+	}
+	cfg.Policy.Groups = oldGroups
+
+	oldDevices := cfg.Devices
+	cfg.Devices = map[string][]device.Rule{"g": {{Platform: "unknown", URL: "http://a"}}}
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("incorrect behavior")
+	}
+	cfg.Devices = map[string][]device.Rule{"g": {{Platform: device.IOS, URL: "http://a"}}}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("incorrect behavior: %v", err)
+	}
+	if rules := cfg.GroupDevices("g"); len(rules) != 1 {
+		t.Errorf("incorrect behavior: %v", rules)
+	}
+	if rules := cfg.GroupDevices("other"); len(rules) != 0 {
+		t.Errorf("incorrect behavior: %v", rules)
+	}
+	cfg.Devices = oldDevices
+
+	oldRedirects := cfg.Redirects
+	cfg.Redirects = map[string]int{"g": 200}
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("incorrect behavior")
+	}
+	cfg.Redirects = map[string]int{"g": 301}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("incorrect behavior: %v", err)
+	}
+	if code := cfg.RedirectCode("g"); code != 301 {
+		t.Errorf("incorrect behavior: %v", code)
+	}
+	if code := cfg.RedirectCode("other"); !ValidRedirect(code) {
+		t.Errorf("incorrect behavior: %v", code)
+	}
+	cfg.Redirects = oldRedirects
+
 	oldCacheURLs := cfg.Cache.URLs
 	cfg.Cache.URLs = -1
 	if err := cfg.Validate(); err == nil {
@@ -168,3 +331,22 @@ func TestNewContext(t *testing.T) {
 		t.Errorf("incorrect behavior")
 	}
 }
+
+func TestCheckStorage(t *testing.T) {
+	cfg := &Config{}
+	if err := cfg.checkStorage(); err != nil || cfg.Storage.Engine != MongoEngine {
+		t.Errorf("incorrect behavior: %v", err)
+	}
+	cfg.Storage.Engine = BoltEngine
+	if err := cfg.checkStorage(); err == nil {
+		t.Errorf("incorrect behavior")
+	}
+	cfg.Storage.File = "luss.db"
+	if err := cfg.checkStorage(); err != nil || !filepath.IsAbs(cfg.Storage.File) {
+		t.Errorf("incorrect behavior: %v", err)
+	}
+	cfg.Storage.Engine = "bad"
+	if err := cfg.checkStorage(); err == nil {
+		t.Errorf("incorrect behavior")
+	}
+}
@@ -15,16 +15,19 @@ import (
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/z0rr0/luss/auth"
 	"github.com/z0rr0/luss/conf"
 	"github.com/z0rr0/luss/db"
+	"github.com/z0rr0/luss/device"
+	"github.com/z0rr0/luss/policy"
+	"github.com/z0rr0/luss/spam"
 	"github.com/z0rr0/luss/stats"
 	"github.com/z0rr0/luss/trim"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
 )
 
 const (
@@ -32,11 +35,40 @@ const (
 	trackerKey key = 1
 	// trackerBuffer is a size of tracker channel.
 	trackerBuffer = 32
+	// trackerTimeout is a max duration of one track saving.
+	trackerTimeout = 10 * time.Second
+	// variantCookie is a cookie name prefix of sticky targets.
+	variantCookie = "luss_v_"
+	// variantAge is a lifetime of sticky target cookie.
+	variantAge = 30 * 24 * time.Hour
+	// passwordPeriod is a period of password attempts limit.
+	passwordPeriod = time.Minute
+	// AccessGranted and AccessDenied are results of password check.
+	AccessGranted = "granted"
+	AccessDenied  = "denied"
+	// healthPerWorker is a number of short URLs checked by one health worker per call.
+	healthPerWorker = 10
+	// healthTimeout is a max duration of one original URL request.
+	healthTimeout = 10 * time.Second
+	// healthUserAgent is User-Agent header of health check requests.
+	healthUserAgent = "luss-health/0.1"
+	// healthRedirects is max number of followed redirects of health check request.
+	healthRedirects = 5
+	// HealthFlag, HealthDisable and HealthNotify are actions
+	// after a configured number of failed health checks.
+	HealthFlag    = "flag"
+	HealthDisable = "disable"
+	HealthNotify  = "notify"
+	// QueryLink and QueryRequest are precedences of merged query parameters.
+	QueryLink    = "link"
+	QueryRequest = "request"
 )
 
 var (
 	// logger is a logger for error messages
 	logger = log.New(os.Stderr, "LOGGER [core]: ", log.Ldate|log.Ltime|log.Lshortfile)
+	// passwords is a limiter of password attempts.
+	passwords = &limiter{items: make(map[string]*attempts)}
 )
 
 // key is a context key type.
@@ -51,9 +83,44 @@ type ErrHandler struct {
 
 // CuInfo is trim.CustomURL info with context.
 type CuInfo struct {
-	ctx  context.Context
-	cu   *trim.CustomURL
-	addr string
+	ctx     context.Context
+	cu      *trim.CustomURL
+	addr    string
+	target  string
+	access  string
+	variant int
+}
+
+// attempts is a number of attempts since the start time.
+type attempts struct {
+	n     int
+	start time.Time
+}
+
+// limiter limits a number of attempts by keys during a period.
+type limiter struct {
+	sync.Mutex
+	items map[string]*attempts
+}
+
+// allow registers new attempt and returns false if the limit is exceeded.
+func (l *limiter) allow(key string, limit int, period time.Duration) bool {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	a, ok := l.items[key]
+	if !ok || now.Sub(a.start) > period {
+		// remove outdated items
+		for k, v := range l.items {
+			if now.Sub(v.start) > period {
+				delete(l.items, k)
+			}
+		}
+		a = &attempts{start: now}
+		l.items[key] = a
+	}
+	a.n++
+	return a.n <= limit
 }
 
 // String return main string info about error handler.
@@ -78,15 +145,25 @@ func tracker(ch <-chan *CuInfo) {
 		// tracker handler
 		go func() {
 			defer wg.Done()
-			if err := stats.Tracker(cui.ctx, cui.cu, cui.addr); err != nil {
+			// request's context and storage can be already closed,
+			// so use own ones for this asynchronous call
+			ctx, cancel := context.WithTimeout(conf.NewContext(c), trackerTimeout)
+			defer cancel()
+			ctx, st, err := db.NewCtxStorage(ctx, c, true)
+			if err != nil {
+				c.L.Error.Println(err)
+				return
+			}
+			defer st.Close()
+			if err := stats.Tracker(ctx, cui.cu, cui.addr, cui.target, cui.access, cui.variant); err != nil {
 				c.L.Error.Println(err)
 			}
 		}()
 		// callback handler
 		go func() {
 			defer wg.Done()
-			// anonymous callbacks will not be handled
-			if cui.cu.User != auth.Anonymous {
+			// anonymous callbacks and denied requests will not be handled
+			if cui.cu.User != auth.Anonymous && cui.access != AccessDenied {
 				if err := stats.Callback(cui.ctx, cui.cu); err != nil {
 					c.L.Error.Println(err)
 				}
@@ -121,30 +198,28 @@ func TrackerChan(ctx context.Context) (chan *CuInfo, error) {
 	return p, nil
 }
 
-// clean disables expired short URLs.
-func clean(c *conf.Config) error {
+// clean disables expired short URLs and removes
+// short URLs which trash period is over.
+func clean(ctx context.Context) error {
 	var change int
-	s, err := db.NewSession(c.Conn, false)
+	c, err := conf.FromContext(ctx)
 	if err != nil {
 		return err
 	}
-	defer s.Close()
-	coll, err := db.Coll(s, "urls")
+	st, err := db.CtxStorage(ctx)
 	if err != nil {
 		return err
 	}
-	condition := bson.D{
-		{Name: "off", Value: false},
-		{Name: "ttl", Value: bson.M{"$lt": time.Now().UTC()}},
-	}
-	update := bson.M{"$set": bson.M{"off": true}}
+	now := time.Now().UTC()
 	cache, cacheOn := c.Cache.Strorage["URL"]
 	if cacheOn {
 		cu := &trim.CustomURL{}
-		iter := coll.Find(condition).Iter()
+		iter := st.ExpiredURLs(ctx, now)
 		for iter.Next(cu) {
-			if err := coll.UpdateId(cu.ID, update); err == nil {
-				cache.Remove(cu.String())
+			if err := st.DisableURL(ctx, cu.ID, db.OffExpired); err == nil {
+				for _, key := range cu.Keys() {
+					cache.Remove(key)
+				}
 				change++
 			}
 		}
@@ -154,50 +229,379 @@ func clean(c *conf.Config) error {
 		}
 	} else {
 		// cache is disable, update only URLs
-		info, err := coll.UpdateAll(condition, update)
+		change, err = st.DisableExpired(ctx, now)
 		if err != nil {
 			return err
 		}
-		change = info.Updated
 	}
 	c.L.Debug.Printf("cleaned %v item(s)", change)
+	removed, err := st.RemoveURLs(ctx, now.AddDate(0, 0, -c.Settings.Trash))
+	if err != nil {
+		return err
+	}
+	c.L.Debug.Printf("removed %v item(s) from trash", removed)
 	return nil
 }
 
+// worker calls fn periodically, only one node does it at the same time,
+// it holds the lock with the key while it is alive.
+func worker(c *conf.Config, key string, period time.Duration, fn func(ctx context.Context) error) {
+	owner := db.LockOwner(c.Settings.Node)
+	tick := time.Tick(period)
+	for range tick {
+		ctx, cancel := context.WithTimeout(conf.NewContext(c), period)
+		ctx, st, err := db.NewCtxStorage(ctx, c, true)
+		if err != nil {
+			cancel()
+			c.L.Error.Printf("%v error: %v", key, err)
+			continue
+		}
+		err = st.AcquireLock(ctx, key, owner, 2*period)
+		switch {
+		case err == db.ErrLocked:
+			c.L.Debug.Printf("%v is skipped, other node does it", key)
+		case err != nil:
+			c.L.Error.Printf("%v lock error: %v", key, err)
+		default:
+			if err := fn(ctx); err != nil {
+				c.L.Error.Printf("%v error: %v", key, err)
+			}
+		}
+		st.Close()
+		cancel()
+	}
+}
+
 // CleanWorker deactivates expired short URLs periodically every 5 minutes.
+// Only one node does it, it holds "clean" lock while it is alive.
 func CleanWorker(c *conf.Config) {
-	tick := time.Tick(time.Duration(c.Settings.CleanMin) * time.Second)
+	worker(c, "clean", time.Duration(c.Settings.CleanMin)*time.Second, clean)
+}
+
+// IDsWorker keeps the node's lock of short URLs identifiers block,
+// so other process with the same node name can't use it.
+func IDsWorker(c *conf.Config) {
+	tick := time.Tick(c.LockTTL() / 3)
 	for range tick {
-		if err := clean(c); err != nil {
-			c.L.Error.Printf("clean error: %v", err)
+		ctx, cancel := context.WithTimeout(conf.NewContext(c), c.LockTTL()/3)
+		ctx, st, err := db.NewCtxStorage(ctx, c, true)
+		if err != nil {
+			cancel()
+			c.L.Error.Printf("identifiers lock error: %v", err)
+			continue
+		}
+		if err := trim.RenewIDs(ctx); err != nil {
+			c.L.Error.Printf("identifiers lock error: %v", err)
 		}
+		st.Close()
+		cancel()
+	}
+}
+
+// rollup compacts raw tracks older than retention period into daily aggregates.
+func rollup(ctx context.Context) error {
+	c, err := conf.FromContext(ctx)
+	if err != nil {
+		return err
+	}
+	st, err := db.CtxStorage(ctx)
+	if err != nil {
+		return err
+	}
+	// only whole days are rolled up
+	before := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -c.Settings.Retention)
+	n, err := st.RollupTracks(ctx, before, c.Settings.RollArch)
+	if err != nil {
+		return err
+	}
+	c.L.Debug.Printf("rolled up %v track(s)", n)
+	return nil
+}
+
+// RollupWorker rolls up old tracks periodically.
+// Only one node does it, it holds "rollup" lock while it is alive.
+func RollupWorker(c *conf.Config) {
+	worker(c, "rollup", time.Duration(c.Settings.RollupMin)*time.Second, rollup)
+}
+
+// rescore recalculates spam score of active short URLs starting after the identifier,
+// it returns last checked identifier or zero if all short URLs are checked.
+func rescore(ctx context.Context, scorer spam.Scorer, after int64) (int64, error) {
+	const batch = 1000
+	c, err := conf.FromContext(ctx)
+	if err != nil {
+		return after, err
+	}
+	st, err := db.CtxStorage(ctx)
+	if err != nil {
+		return after, err
+	}
+	cache, cacheOn := c.Cache.Strorage["URL"]
+	for {
+		var n, changed int
+		iter := st.ScanURLs(ctx, after, batch)
+		for {
+			// new item for every document, so omitted fields are not kept from previous ones
+			cu := &trim.CustomURL{}
+			if !iter.Next(cu) {
+				break
+			}
+			n++
+			after = cu.ID
+			score, err := cu.SpamScore(ctx, scorer)
+			if err != nil {
+				iter.Close()
+				return after, err
+			}
+			if score == cu.Spam {
+				continue
+			}
+			set := map[string]interface{}{"spam": score}
+			if score > float64(c.Settings.MaxSpam) && c.Settings.SpamAction != spam.Preview {
+				set["off"], set["why"] = true, db.OffSpam
+			}
+			if err := st.UpdateURL(ctx, cu.ID, set); err != nil {
+				iter.Close()
+				return after, err
+			}
+			if cacheOn {
+				for _, key := range cu.Keys() {
+					cache.Remove(key)
+				}
+			}
+			changed++
+		}
+		if err := iter.Close(); err != nil {
+			return after, err
+		}
+		c.L.Debug.Printf("spam score is changed for %v of %v item(s)", changed, n)
+		if n < batch {
+			return 0, nil
+		}
+	}
+}
+
+// SpamWorker periodically recalculates spam score of active short URLs,
+// every call continues the check from a last checked item.
+func SpamWorker(c *conf.Config, scorer spam.Scorer) {
+	var after int64
+	worker(c, "spam", time.Duration(c.Settings.SpamCheck)*time.Second, func(ctx context.Context) error {
+		var err error
+		after, err = rescore(ctx, scorer, after)
+		return err
+	})
+}
+
+// newHealthClient returns HTTP client of health checks. Original URLs are set by users,
+// so the client doesn't connect to local networks (addresses are checked after DNS resolution)
+// and follows a limited number of HTTP(S) redirects.
+func newHealthClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: healthTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || policy.IsLocal(ip) {
+				return fmt.Errorf("local address %v is not allowed", host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: healthTimeout,
+		// no proxy, so the dialer checks real addresses
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: healthTimeout},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= healthRedirects {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to %v scheme is not allowed", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// checkURL requests the original URL and returns HTTP status code,
+// HEAD request is repeated by GET one if the method is not supported.
+func checkURL(ctx context.Context, client *http.Client, original string) (int, error) {
+	var status int
+	for _, method := range []string{"HEAD", "GET"} {
+		req, err := http.NewRequest(method, original, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("User-Agent", healthUserAgent)
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		status = resp.StatusCode
+		if status != http.StatusMethodNotAllowed && status != http.StatusNotImplemented {
+			break
+		}
+	}
+	return status, nil
+}
+
+// checkHealth checks the original URL and saves the result,
+// the configured action is done after "healthfails" failed checks in a row.
+func checkHealth(ctx context.Context, client *http.Client, cu *trim.CustomURL) error {
+	c, err := conf.FromContext(ctx)
+	if err != nil {
+		return err
+	}
+	st, err := db.CtxStorage(ctx)
+	if err != nil {
+		return err
+	}
+	status, err := checkURL(ctx, client, cu.Original)
+	if ctx.Err() != nil {
+		// worker is stopped, it isn't a failure of the URL
+		return ctx.Err()
+	}
+	h := &trim.Health{Status: status, Checked: time.Now().UTC()}
+	if err != nil || status >= http.StatusBadRequest {
+		if cu.Health != nil {
+			h.Fails = cu.Health.Fails
+		}
+		h.Fails++
+		if err != nil {
+			h.Err = err.Error()
+		}
+	}
+	h.Flagged = h.Fails >= c.Settings.HealthFails
+	cu.Health = h
+	set := map[string]interface{}{"health": h}
+	if h.Fails == c.Settings.HealthFails {
+		c.L.Info.Printf("health check failed [%v] %v times: %v", cu.Original, h.Fails, c.Settings.HealthAction)
+		switch c.Settings.HealthAction {
+		case HealthDisable:
+			set["off"], set["why"] = true, db.OffHealth
+		case HealthNotify:
+			if cu.User == auth.Anonymous {
+				break
+			}
+			if err := stats.HealthCallback(ctx, cu); err != nil {
+				c.L.Error.Printf("health callback error [%v]: %v", cu.ID, err)
+			}
+		}
+	}
+	if err := st.UpdateURL(ctx, cu.ID, set); err != nil {
+		return err
+	}
+	if cache, ok := c.Cache.Strorage["URL"]; ok {
+		for _, key := range cu.Keys() {
+			cache.Remove(key)
+		}
+	}
+	return nil
+}
+
+// healthCheck checks original URLs of a batch of active short URLs
+// using a pool of workers, it returns last checked identifier
+// or zero if all short URLs are checked.
+func healthCheck(ctx context.Context, client *http.Client, after int64) (int64, error) {
+	var wg sync.WaitGroup
+	c, err := conf.FromContext(ctx)
+	if err != nil {
+		return after, err
+	}
+	st, err := db.CtxStorage(ctx)
+	if err != nil {
+		return after, err
+	}
+	batch := c.Settings.HealthNum * healthPerWorker
+	cus := make([]*trim.CustomURL, 0, batch)
+	iter := st.ScanURLs(ctx, after, batch)
+	cu := &trim.CustomURL{}
+	for iter.Next(cu) {
+		cus = append(cus, cu)
+		cu = &trim.CustomURL{}
+	}
+	if err := iter.Close(); err != nil {
+		return after, err
+	}
+	ch := make(chan *trim.CustomURL)
+	for i := 0; i < c.Settings.HealthNum; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for cu := range ch {
+				if err := checkHealth(ctx, client, cu); err != nil {
+					c.L.Error.Printf("health check error [%v]: %v", cu.ID, err)
+				}
+			}
+		}()
+	}
+	for _, cu := range cus {
+		ch <- cu
 	}
+	close(ch)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		// not finished batch will be checked again
+		return after, err
+	}
+	c.L.Debug.Printf("health of %v item(s) is checked", len(cus))
+	if len(cus) < batch {
+		return 0, nil
+	}
+	return cus[len(cus)-1].ID, nil
+}
+
+// HealthWorker periodically checks original URLs of active short URLs,
+// every call continues the check from a last checked item.
+func HealthWorker(c *conf.Config) {
+	var after int64
+	client := newHealthClient()
+	worker(c, "health", time.Duration(c.Settings.HealthCheck)*time.Second, func(ctx context.Context) error {
+		var err error
+		after, err = healthCheck(ctx, client, after)
+		return err
+	})
 }
 
 // validateParams checks HTTP parameters.
 func validateParams(r *http.Request) (*trim.ReqParams, error) {
 	var (
-		nd  bool
-		ttl *time.Time
+		nd     bool
+		hours  uint64
+		clicks int64
+		err    error
 	)
 	if v := r.PostFormValue("ttl"); v != "" {
-		t, err := strconv.ParseUint(v, 10, 64)
+		hours, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ttl, err := trim.ExpireTime(hours, r.PostFormValue("expire"))
+	if err != nil {
+		return nil, err
+	}
+	if v := r.PostFormValue("clicks"); v != "" {
+		clicks, err = strconv.ParseInt(v, 10, 64)
 		if err != nil {
 			return nil, err
 		}
-		expire := time.Now().Add(time.Duration(t) * time.Hour).UTC()
-		ttl = &expire
 	}
 	if v := r.PostFormValue("nd"); v != "" {
 		nd = true
 	}
 	params := &trim.ReqParams{
 		Original:  r.PostFormValue("url"),
+		Alias:     strings.TrimSpace(r.PostFormValue("alias")),
 		Tag:       r.PostFormValue("tag"),
 		NotDirect: nd,
 		TTL:       ttl,
+		MaxClicks: clicks,
 	}
-	err := params.Valid()
+	err = params.Valid()
 	if err != nil {
 		return nil, err
 	}
@@ -219,21 +623,21 @@ func HandlerTest(ctx context.Context, w http.ResponseWriter, r *http.Request) Er
 	if err != nil {
 		return ErrHandler{err, http.StatusInternalServerError}
 	}
-	coll, err := db.C(ctx, "tests")
+	st, err := db.CtxStorage(ctx)
 	if err != nil {
 		return ErrHandler{err, http.StatusInternalServerError}
 	}
 	command := r.FormValue("write")
 	switch {
 	case c.Debug && command == "add":
-		err = coll.Insert(bson.M{"ts": time.Now()})
+		err = st.AddTest(ctx, time.Now())
 	case c.Debug && command == "del":
-		err = coll.Remove(nil)
+		err = st.RemoveTest(ctx)
 	}
-	if err != nil && err != mgo.ErrNotFound {
+	if err != nil && err != db.ErrNotFound {
 		return ErrHandler{err, http.StatusInternalServerError}
 	}
-	n, err := coll.Count()
+	n, err := st.CountTests(ctx)
 	if err != nil {
 		return ErrHandler{err, http.StatusInternalServerError}
 	}
@@ -246,36 +650,233 @@ func HandlerTest(ctx context.Context, w http.ResponseWriter, r *http.Request) Er
 	return ErrHandler{nil, http.StatusOK}
 }
 
-// HandlerRedirect searches saved original URL by a short one.
-func HandlerRedirect(ctx context.Context, short string, r *http.Request) (string, error) {
+// clientAddr returns client's address, it can be taken
+// from proxy header if it's set in the configuration.
+func clientAddr(c *conf.Config, r *http.Request) string {
+	addr := r.RemoteAddr
+	if headProxy := c.Settings.TrackProxy; headProxy != "" {
+		if proxyIP := r.Header.Get(headProxy); proxyIP != "" {
+			_, port, _ := net.SplitHostPort(addr)
+			addr = net.JoinHostPort(proxyIP, port)
+		}
+	}
+	return addr
+}
+
+// track sends short URL request info to the tracker,
+// target is an URL that was served for the request.
+func track(ctx context.Context, c *conf.Config, cu *trim.CustomURL, r *http.Request, target, access string, variant int) {
+	if !c.Settings.TrackOn {
+		return
+	}
+	ch, err := TrackerChan(ctx)
+	if err != nil {
+		// tracker's error is not critical
+		// so only print it here
+		c.L.Error.Println(err)
+		return
+	}
+	ch <- &CuInfo{ctx, cu, clientAddr(c, r), target, access, variant}
+}
+
+// clientCountry returns ISO country code of the client,
+// it's empty if the country is unknown.
+func clientCountry(c *conf.Config, r *http.Request) string {
+	host, _, err := net.SplitHostPort(clientAddr(c, r))
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || c.GeoDB == nil {
+		return ""
+	}
+	record, err := c.GeoDB.Country(ip)
+	if err != nil {
+		c.L.Debug.Printf("unknown country [%v]: %v", host, err)
+		return ""
+	}
+	return record.Country.IsoCode
+}
+
+// destination returns a target of short URL for the request,
+// device rules (own or group ones) have priority over geo rules and
+// weighted targets, sticky short URLs save a chosen target variant in the cookie.
+func destination(c *conf.Config, cu *trim.CustomURL, w http.ResponseWriter, r *http.Request) (int, string) {
+	var previous int
+	rules := cu.Devices
+	if len(rules) == 0 {
+		rules = c.GroupDevices(cu.Group)
+	}
+	if len(rules) > 0 {
+		if original, ok := device.Match(rules, device.Detect(r.UserAgent())); ok {
+			return 0, original
+		}
+	}
+	if len(cu.Geo) > 0 {
+		if original, ok := cu.GeoURL(clientCountry(c, r)); ok {
+			return 0, original
+		}
+	}
+	if len(cu.Targets) == 0 {
+		return cu.Destination(0)
+	}
+	name := variantCookie + trim.Encode(cu.ID)
+	if cu.Sticky {
+		if cookie, err := r.Cookie(name); err == nil {
+			previous, _ = strconv.Atoi(cookie.Value)
+		}
+	}
+	variant, original := cu.Destination(previous)
+	if cu.Sticky && variant != previous {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    strconv.Itoa(variant),
+			Path:     "/",
+			MaxAge:   int(variantAge.Seconds()),
+			HttpOnly: true,
+		})
+	}
+	return variant, original
+}
+
+// checkPassword verifies a password of protected short URL,
+// it renders password form page if access is not granted.
+func checkPassword(ctx context.Context, c *conf.Config, cu *trim.CustomURL, w http.ResponseWriter, r *http.Request) (bool, ErrHandler) {
+	data := map[string]string{}
+	if r.Method == "POST" {
+		host, _, err := net.SplitHostPort(clientAddr(c, r))
+		if err != nil {
+			return false, ErrHandler{err, http.StatusBadRequest}
+		}
+		if !passwords.allow(host+"/"+cu.String(), c.PasswordLimit(), passwordPeriod) {
+			return false, ErrHandler{errors.New("too many password attempts"), http.StatusTooManyRequests}
+		}
+		if cu.CheckPassword(r.PostFormValue("password")) {
+			return true, ErrHandler{nil, http.StatusOK}
+		}
+		track(ctx, c, cu, r, "", AccessDenied, 0)
+		data["Error"] = "Invalid password."
+	}
+	tpl, err := c.CacheTpl("password", "base.html", "password.html")
+	if err != nil {
+		return false, ErrHandler{err, http.StatusInternalServerError}
+	}
+	err = tpl.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		return false, ErrHandler{err, http.StatusInternalServerError}
+	}
+	return false, ErrHandler{nil, http.StatusOK}
+}
+
+// redirectCode returns HTTP status code of the short URL redirect,
+// the group's one is used for links without own code.
+// POST requests of password forms are always redirected by GET ones.
+func redirectCode(c *conf.Config, cu *trim.CustomURL, r *http.Request) int {
+	code := cu.Code
+	if code == 0 {
+		code = c.RedirectCode(cu.Group)
+	}
+	if r.Method == "POST" && trim.KeepsMethod(code) {
+		return http.StatusSeeOther
+	}
+	return code
+}
+
+// cacheHeaders sets caching headers of the redirect response,
+// only permanent short URLs with the same destination for all clients can be cached.
+func cacheHeaders(c *conf.Config, cu *trim.CustomURL, w http.ResponseWriter) {
+	age := c.CacheAge()
+	if age > 0 && !cu.Temporary() && len(c.GroupDevices(cu.Group)) == 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(age.Seconds())))
+		w.Header().Set("Expires", time.Now().Add(age).UTC().Format(http.TimeFormat))
+		return
+	}
+	w.Header().Set("Cache-Control", "private, no-cache, no-store, must-revalidate")
+	w.Header().Set("Expires", time.Unix(0, 0).UTC().Format(http.TimeFormat))
+}
+
+// HandlerRedirect redirects to the original URL of the short one,
+// a preview page is shown instead if direct redirect is not allowed.
+// Protected short URLs require a password before the redirect.
+// The path suffix after short URL is forwarded only if it's allowed for the link.
+// HEAD requests don't spend clicks and aren't tracked.
+func HandlerRedirect(ctx context.Context, short, suffix string, w http.ResponseWriter, r *http.Request) ErrHandler {
+	var access string
 	cu, err := trim.Lengthen(ctx, short)
 	if err != nil {
-		return "", err
+		if err == db.ErrNotFound {
+			return ErrHandler{err, http.StatusNotFound}
+		}
+		return ErrHandler{err, http.StatusInternalServerError}
 	}
 	c, err := conf.FromContext(ctx)
 	if err != nil {
-		return "", err
+		return ErrHandler{err, http.StatusInternalServerError}
+	}
+	if suffix != "" && !cu.Suffix {
+		return ErrHandler{db.ErrNotFound, http.StatusNotFound}
+	}
+	spammed := cu.IsSpam(c)
+	if spammed && c.Settings.SpamAction != spam.Preview {
+		return ErrHandler{db.ErrNotFound, http.StatusNotFound}
 	}
-	if c.Settings.TrackOn {
-		ch, err := TrackerChan(ctx)
+	if cu.Protected() {
+		ok, eh := checkPassword(ctx, c, cu, w, r)
+		if !ok {
+			return eh
+		}
+		access = AccessGranted
+	} else if r.Method != "GET" && r.Method != "HEAD" {
+		return ErrHandler{errors.New("method not allowed"), http.StatusMethodNotAllowed}
+	}
+	head := r.Method == "HEAD"
+	if head {
+		if cu.Expired() {
+			return ErrHandler{db.ErrNotFound, http.StatusNotFound}
+		}
+	} else {
+		err = trim.Click(ctx, cu)
 		if err != nil {
-			// tracker's error is not critical
-			// so only print it here
-			c.L.Error.Println(err)
-		} else {
-			cui := &CuInfo{ctx, cu, r.RemoteAddr}
-			if headProxy := c.Settings.TrackProxy; headProxy != "" {
-				if proxyIP := r.Header.Get(headProxy); proxyIP != "" {
-					_, port, _ := net.SplitHostPort(cui.addr)
-					cui.addr = net.JoinHostPort(proxyIP, port)
-				}
+			if err == db.ErrNotFound {
+				return ErrHandler{err, http.StatusNotFound}
 			}
-			ch <- cui
+			return ErrHandler{err, http.StatusInternalServerError}
 		}
-
 	}
-	// TODO: check direct redirect
-	return cu.Original, nil
+	variant, original := destination(c, cu, w, r)
+	original, err = cu.Forward(original, suffix, r.URL.RawQuery, c.Settings.QueryWins == QueryRequest)
+	if err != nil {
+		return ErrHandler{err, http.StatusBadRequest}
+	}
+	if !head {
+		track(ctx, c, cu, r, original, access, variant)
+	}
+	// password form is already a preview page for not direct links
+	if !spammed && (!cu.NotDirect || cu.Protected()) {
+		code := redirectCode(c, cu, r)
+		cacheHeaders(c, cu, w)
+		http.Redirect(w, r, original, code)
+		return ErrHandler{nil, code}
+	}
+	tpl, err := c.CacheTpl("redirect", "base.html", "redirect.html")
+	if err != nil {
+		return ErrHandler{err, http.StatusInternalServerError}
+	}
+	data := map[string]interface{}{
+		"Original":  original,
+		"Group":     cu.Group,
+		"Countdown": c.Settings.Countdown,
+		"Spam":      spammed,
+	}
+	if spammed {
+		// no automatic redirect to suspicious URL
+		data["Countdown"] = 0
+	}
+	err = tpl.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		return ErrHandler{err, http.StatusInternalServerError}
+	}
+	return ErrHandler{nil, http.StatusOK}
 }
 
 // HandlerIndex returns index web page.
@@ -303,7 +904,23 @@ func HandlerIndex(ctx context.Context, w http.ResponseWriter, r *http.Request) E
 		params := []*trim.ReqParams{p}
 		cus, err := trim.Shorten(ctx, params)
 		if err != nil {
-			return ErrHandler{err, http.StatusInternalServerError}
+			switch err {
+			case trim.ErrAliasUsed:
+				data["Error"] = "The alias is already used."
+			case trim.ErrSpam:
+				data["Error"] = "The URL looks like spam."
+			default:
+				pe, ok := err.(*trim.PolicyError)
+				if !ok {
+					return ErrHandler{err, http.StatusInternalServerError}
+				}
+				data["Error"] = fmt.Sprintf("The URL is not allowed: %v.", pe.Err)
+			}
+			err = tpl.ExecuteTemplate(w, "base", data)
+			if err != nil {
+				return ErrHandler{err, http.StatusInternalServerError}
+			}
+			return ErrHandler{nil, http.StatusOK}
 		}
 		data["Result"] = c.Address(cus[0].String())
 	}
@@ -340,7 +957,13 @@ func HandlerNoWebIndex(ctx context.Context, w http.ResponseWriter, r *http.Reque
 	params := []*trim.ReqParams{param}
 	cus, err := trim.Shorten(ctx, params)
 	if err != nil {
-		fmt.Fprintf(w, "error: internal error\n")
+		if pe, ok := err.(*trim.PolicyError); ok {
+			fmt.Fprintf(w, "error: %v\n", pe.Err)
+		} else if err == trim.ErrSpam {
+			fmt.Fprintf(w, "error: spam url\n")
+		} else {
+			fmt.Fprintf(w, "error: internal error\n")
+		}
 		return ErrHandler{nil, http.StatusOK}
 	}
 	fmt.Fprintf(w, "%s\n", c.Address(cus[0].String()))
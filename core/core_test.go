@@ -9,11 +9,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/z0rr0/luss/auth"
 	"github.com/z0rr0/luss/conf"
 	"github.com/z0rr0/luss/db"
 	"github.com/z0rr0/luss/test"
+	"github.com/z0rr0/luss/trim"
 )
 
 func TestHandlerTest(t *testing.T) {
@@ -31,12 +33,11 @@ func TestHandlerTest(t *testing.T) {
 	r := &http.Request{}
 	ctx, _ = auth.CheckToken(ctx, r, false)
 
-	s, err := db.NewSession(cfg.Conn, true)
+	ctx, st, err := db.NewCtxStorage(ctx, cfg, true)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer s.Close()
-	ctx = db.NewContext(ctx, s)
+	defer st.Close()
 
 	ctx, err = auth.Authenticate(ctx)
 	if err != nil {
@@ -51,3 +52,84 @@ func TestHandlerTest(t *testing.T) {
 		t.Error("invalid behavior")
 	}
 }
+
+func TestLimiter(t *testing.T) {
+	l := &limiter{items: make(map[string]*attempts)}
+	for i := 0; i < 3; i++ {
+		if !l.allow("a", 3, time.Minute) {
+			t.Errorf("incorrect behavior: %v", i)
+		}
+	}
+	if l.allow("a", 3, time.Minute) {
+		t.Error("incorrect behavior")
+	}
+	if !l.allow("b", 3, time.Minute) {
+		t.Error("incorrect behavior")
+	}
+	if !l.allow("a", 3, 0) || len(l.items) != 1 {
+		t.Errorf("incorrect behavior: %v", len(l.items))
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case r.URL.Path == "/get" && r.Method == "HEAD":
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer server.Close()
+	ctx := context.Background()
+	client := &http.Client{Timeout: time.Second}
+	suite := map[string]int{
+		"/":        http.StatusOK,
+		"/get":     http.StatusOK,
+		"/missing": http.StatusNotFound,
+	}
+	for path, expected := range suite {
+		if status, err := checkURL(ctx, client, server.URL+path); err != nil || status != expected {
+			t.Errorf("incorrect behavior [%v]: %v, %v", path, status, err)
+		}
+	}
+	if _, err := checkURL(ctx, client, "http://127.0.0.1:1/"); err == nil {
+		t.Error("incorrect behavior")
+	}
+	// health checks client doesn't request local addresses
+	if _, err := checkURL(ctx, newHealthClient(), server.URL); err == nil {
+		t.Error("incorrect behavior")
+	}
+}
+
+func TestCacheHeaders(t *testing.T) {
+	c := &conf.Config{Redirects: map[string]int{"g": http.StatusMovedPermanently}}
+	c.Settings.CacheAge = 60
+	ttl := time.Now().Add(time.Hour)
+	suite := []struct {
+		cu      *trim.CustomURL
+		code    int
+		control string
+	}{
+		{&trim.CustomURL{}, http.StatusFound, "public, max-age=60"},
+		{&trim.CustomURL{Group: "g"}, http.StatusMovedPermanently, "public, max-age=60"},
+		{&trim.CustomURL{Group: "g", Code: http.StatusPermanentRedirect}, http.StatusPermanentRedirect, "public, max-age=60"},
+		{&trim.CustomURL{TTL: &ttl}, http.StatusFound, "private, no-cache, no-store, must-revalidate"},
+		{&trim.CustomURL{MaxClicks: 1}, http.StatusFound, "private, no-cache, no-store, must-revalidate"},
+		{&trim.CustomURL{Targets: []trim.Target{{URL: "http://a"}}}, http.StatusFound, "private, no-cache, no-store, must-revalidate"},
+	}
+	for i, v := range suite {
+		w := httptest.NewRecorder()
+		cacheHeaders(c, v.cu, w)
+		if code := redirectCode(c, v.cu, httptest.NewRequest("GET", "/", nil)); code != v.code {
+			t.Errorf("incorrect behavior [%v]: %v", i, code)
+		}
+		if h := w.Header().Get("Cache-Control"); h != v.control || w.Header().Get("Expires") == "" {
+			t.Errorf("incorrect behavior [%v]: %v", i, h)
+		}
+	}
+	cu := &trim.CustomURL{Code: http.StatusPermanentRedirect}
+	if code := redirectCode(c, cu, httptest.NewRequest("POST", "/", nil)); code != http.StatusSeeOther {
+		t.Errorf("incorrect behavior: %v", code)
+	}
+}
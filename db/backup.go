@@ -0,0 +1,236 @@
+// Copyright 2016 Alexander Zaytsev <thebestzorro@yandex.ru>
+// Use of this source code is governed by a GPL-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// backupFormat is a name of backup archive format.
+	backupFormat = "luss-backup"
+	// backupVersion is a current version of backup archive format.
+	backupVersion = 1
+	// restoreBatch is max number of documents restored by one call.
+	restoreBatch = 1000
+	// restoreLockTTL is a lease time of nodes' identifiers locks held by restore,
+	// they are renewed after every restored batch.
+	restoreLockTTL = time.Minute
+)
+
+// BackupColls are collections that can be saved to backup archive,
+// raw tracks are the last one, they are optional.
+var BackupColls = []string{"urls", "users", "rollups", "tracks"}
+
+// backupHeader is the first document of backup archive.
+type backupHeader struct {
+	Format  string    `bson:"format"`
+	Version int       `bson:"version"`
+	Colls   []string  `bson:"colls"`
+	Created time.Time `bson:"ts"`
+}
+
+// backupRecord is a document of backup archive.
+type backupRecord struct {
+	Coll string   `bson:"c"`
+	Doc  bson.Raw `bson:"d"`
+}
+
+// writeDoc writes BSON document.
+func writeDoc(w io.Writer, doc interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// readDoc reads next BSON document, io.EOF is returned if there are no more documents.
+func readDoc(r io.Reader) (bson.Raw, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(size[:])
+	if n < 5 {
+		return nil, errors.New("invalid backup document")
+	}
+	data := make([]byte, n)
+	copy(data, size[:])
+	if _, err := io.ReadFull(r, data[4:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return bson.Raw(data), nil
+}
+
+// Backup writes compressed archive of short URLs, users, tracks aggregates and optionally raw tracks.
+// It returns numbers of saved documents by collections.
+func Backup(ctx context.Context, st Storage, w io.Writer, tracks bool) (map[string]int, error) {
+	colls := BackupColls
+	if !tracks {
+		colls = colls[:len(colls)-1]
+	}
+	zw := gzip.NewWriter(w)
+	header := &backupHeader{Format: backupFormat, Version: backupVersion, Colls: colls, Created: time.Now().UTC()}
+	if err := writeDoc(zw, header); err != nil {
+		return nil, err
+	}
+	result := make(map[string]int, len(colls))
+	for _, name := range colls {
+		err := st.DumpDocs(ctx, name, func(doc []byte) error {
+			result[name]++
+			return writeDoc(zw, &backupRecord{Coll: name, Doc: doc})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, zw.Close()
+}
+
+// nodeLocks are identifiers blocks locks of all nodes with leases.
+type nodeLocks struct {
+	st    Storage
+	owner string
+	keys  []string
+}
+
+// acquire takes locks of all nodes, it fails if some node is running,
+// so nodes can't issue identifiers of their blocks during restore.
+func (l *nodeLocks) acquire(ctx context.Context) error {
+	var nodes []string
+	err := l.st.DumpDocs(ctx, "leases", func(doc []byte) error {
+		lease := &Lease{}
+		if err := bson.Unmarshal(doc, lease); err != nil {
+			return err
+		}
+		nodes = append(nodes, lease.Node)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		key := "ids:" + node
+		if err := l.st.AcquireLock(ctx, key, l.owner, restoreLockTTL); err != nil {
+			if err == ErrLocked {
+				err = fmt.Errorf("node %v is running, it should be stopped before restore", node)
+			}
+			l.release(ctx)
+			return err
+		}
+		l.keys = append(l.keys, key)
+	}
+	return nil
+}
+
+// renew prolongs held locks.
+func (l *nodeLocks) renew(ctx context.Context) error {
+	for _, key := range l.keys {
+		if err := l.st.RenewLock(ctx, key, l.owner, restoreLockTTL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// release releases held locks, nodes reload their blocks after restore.
+func (l *nodeLocks) release(ctx context.Context) {
+	for _, key := range l.keys {
+		if err := l.st.ReleaseLock(ctx, key, l.owner); err != nil {
+			Logger.Printf("release lock %v error: %v", key, err)
+		}
+	}
+	l.keys = nil
+}
+
+// Restore reads backup archive and saves its documents with the same identifiers,
+// existing documents are replaced. It's refused if some node is running, because
+// restored identifiers can be inside of node's current block. Short URLs counter
+// is moved after restored items, so new short URLs don't collide with them.
+func Restore(ctx context.Context, st Storage, r io.Reader) (map[string]int, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	data, err := readDoc(zr)
+	if err != nil {
+		return nil, err
+	}
+	header := &backupHeader{}
+	if err := bson.Unmarshal(data, header); err != nil {
+		return nil, err
+	}
+	switch {
+	case header.Format != backupFormat:
+		return nil, errors.New("unknown backup format")
+	case header.Version > backupVersion:
+		return nil, fmt.Errorf("unsupported backup version %v", header.Version)
+	}
+	locks := &nodeLocks{st: st, owner: LockOwner("restore")}
+	if err := locks.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer locks.release(ctx)
+	allowed := make(map[string]bool, len(header.Colls))
+	for _, name := range header.Colls {
+		allowed[name] = true
+	}
+	result := make(map[string]int, len(header.Colls))
+	batches := make(map[string][][]byte, len(header.Colls))
+	flush := func(name string) error {
+		if err := st.RestoreDocs(ctx, name, batches[name]); err != nil {
+			return err
+		}
+		result[name] += len(batches[name])
+		batches[name] = nil
+		return locks.renew(ctx)
+	}
+	for {
+		data, err := readDoc(zr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		record := &backupRecord{}
+		if err := bson.Unmarshal(data, record); err != nil {
+			return nil, err
+		}
+		if !allowed[record.Coll] {
+			return nil, fmt.Errorf("unexpected backup collection %v", record.Coll)
+		}
+		batches[record.Coll] = append(batches[record.Coll], record.Doc)
+		if len(batches[record.Coll]) >= restoreBatch {
+			if err := flush(record.Coll); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for name := range batches {
+		if err := flush(name); err != nil {
+			return nil, err
+		}
+	}
+	maxID, err := st.MaxURL(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return result, st.SyncURLs(ctx, maxID)
+}
@@ -0,0 +1,956 @@
+// Copyright 2016 Alexander Zaytsev <thebestzorro@yandex.ru>
+// Use of this source code is governed by a GPL-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/z0rr0/luss/conf"
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Bolt is embedded single-file data storage,
+// every collection is a bucket of BSON documents.
+type Bolt struct {
+	DB *bbolt.DB
+}
+
+// boltIndexes are buckets of unique secondary keys.
+// aliases bucket contains short URLs keys by their aliases.
+var boltIndexes = []string{"aliases"}
+
+// boltURL contains short URL fields that are used in filters.
+type boltURL struct {
+	ID       int64      `bson:"_id"`
+	Alias    string     `bson:"alias"`
+	Disabled bool       `bson:"off"`
+	Group    string     `bson:"group"`
+	Tag      string     `bson:"tag"`
+	Norm     string     `bson:"norm"`
+	User     string     `bson:"u"`
+	TTL      *time.Time `bson:"ttl"`
+	Deleted  *time.Time `bson:"del"`
+	Left     int64      `bson:"left"`
+	Spam     float64    `bson:"spam"`
+	Created  time.Time  `bson:"ts"`
+}
+
+// boltUser contains user's fields that are used in filters.
+type boltUser struct {
+	Name     string `bson:"_id"`
+	Disabled bool   `bson:"off"`
+	Token    string `bson:"token"`
+}
+
+// boltIter is an iterator over documents read from Bolt storage.
+type boltIter struct {
+	docs [][]byte
+	err  error
+}
+
+// Next decodes the next document into result.
+func (it *boltIter) Next(result interface{}) bool {
+	if it.err != nil || len(it.docs) == 0 {
+		return false
+	}
+	it.err = bson.Unmarshal(it.docs[0], result)
+	it.docs = it.docs[1:]
+	return it.err == nil
+}
+
+// Close closes the iterator.
+func (it *boltIter) Close() error {
+	it.docs = nil
+	return it.err
+}
+
+// match checks that short URL is satisfied to the filter.
+func (f *Filter) match(u *boltURL) bool {
+	switch {
+	case u.Group != f.Group || u.Tag != f.Tag:
+		return false
+	case f.Active && u.Disabled:
+		return false
+	case f.Period[0] != nil && u.Created.Before(*f.Period[0]):
+		return false
+	case f.Period[1] != nil && u.Created.After(*f.Period[1]):
+		return false
+	}
+	return true
+}
+
+// boltConnection opens Bolt database file and prepares its buckets.
+func boltConnection(cfg *conf.StorageCfg) (*bbolt.DB, error) {
+	options := &bbolt.Options{Timeout: time.Duration(cfg.Timeout) * time.Second}
+	bdb, err := bbolt.Open(cfg.File, 0600, options)
+	if err != nil {
+		return nil, err
+	}
+	err = bdb.Update(func(tx *bbolt.Tx) error {
+		for _, name := range Colls {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		for _, name := range boltIndexes {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		bdb.Close()
+		return nil, err
+	}
+	return bdb, nil
+}
+
+// NewBolt returns Bolt data storage.
+// Database file is opened only once and it is shared between storages.
+func NewBolt(c *conf.Conn) (*Bolt, error) {
+	c.M.Lock()
+	defer c.M.Unlock()
+	if c.B == nil {
+		bdb, err := boltConnection(c.Storage)
+		if err != nil {
+			return nil, err
+		}
+		Logger.Printf("new bolt database: %v", c.Storage.File)
+		c.B = bdb
+	}
+	return &Bolt{DB: c.B}, nil
+}
+
+// urlKey returns a key of short URL identifier,
+// it keeps a numeric order for negative values too.
+func urlKey(id int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(id)^(1<<63))
+	return b
+}
+
+// seqKey returns a key of bucket's sequence number.
+func seqKey(b *bbolt.Bucket) ([]byte, error) {
+	n, err := b.NextSequence()
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, n)
+	return key, nil
+}
+
+// bucket returns a bucket by collection alias name or index name.
+func bucket(tx *bbolt.Tx, name string) *bbolt.Bucket {
+	if cname, ok := Colls[name]; ok {
+		return tx.Bucket([]byte(cname))
+	}
+	return tx.Bucket([]byte(name))
+}
+
+// setFields sets new fields values of a document.
+func setFields(b *bbolt.Bucket, key []byte, set bson.M) error {
+	data := b.Get(key)
+	if data == nil {
+		return ErrNotFound
+	}
+	doc := bson.M{}
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	for k, v := range set {
+		doc[k] = v
+	}
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+// view runs read-only transaction if the context is not done yet.
+func (bs *Bolt) view(ctx context.Context, fn func(tx *bbolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return bs.DB.View(fn)
+}
+
+// update runs read-write transaction if the context is not done yet.
+func (bs *Bolt) update(ctx context.Context, fn func(tx *bbolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return bs.DB.Update(fn)
+}
+
+// Close does nothing, because database file is shared.
+func (bs *Bolt) Close() {
+}
+
+// putURL saves short URL document and its alias key,
+// existing short URL is replaced only if replace is true.
+func putURL(tx *bbolt.Tx, data []byte, replace bool) error {
+	b, ab := bucket(tx, "urls"), bucket(tx, "aliases")
+	u := &boltURL{}
+	if err := bson.Unmarshal(data, u); err != nil {
+		return err
+	}
+	key := urlKey(u.ID)
+	if old := b.Get(key); old != nil {
+		if !replace {
+			return ErrDuplicate
+		}
+		prev := &boltURL{}
+		if err := bson.Unmarshal(old, prev); err != nil {
+			return err
+		}
+		if prev.Alias != "" {
+			if err := ab.Delete([]byte(prev.Alias)); err != nil {
+				return err
+			}
+		}
+	}
+	if u.Alias != "" {
+		if k := ab.Get([]byte(u.Alias)); k != nil && !bytes.Equal(k, key) {
+			return ErrDuplicate
+		}
+		if err := ab.Put([]byte(u.Alias), key); err != nil {
+			return err
+		}
+	}
+	return b.Put(key, data)
+}
+
+// InsertURLs saves new short URLs.
+func (bs *Bolt) InsertURLs(ctx context.Context, docs ...interface{}) error {
+	return bs.update(ctx, func(tx *bbolt.Tx) error {
+		for _, doc := range docs {
+			data, err := bson.Marshal(doc)
+			if err != nil {
+				return err
+			}
+			if err := putURL(tx, data, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// findURL reads a short URL by its key.
+func findURL(tx *bbolt.Tx, key []byte, active bool, result interface{}) error {
+	data := bucket(tx, "urls").Get(key)
+	if data == nil {
+		return ErrNotFound
+	}
+	if active {
+		u := &boltURL{}
+		if err := bson.Unmarshal(data, u); err != nil {
+			return err
+		}
+		if u.Disabled {
+			return ErrNotFound
+		}
+	}
+	return bson.Unmarshal(data, result)
+}
+
+// FindURL finds a short URL by its identifier.
+func (bs *Bolt) FindURL(ctx context.Context, id int64, active bool, result interface{}) error {
+	return bs.view(ctx, func(tx *bbolt.Tx) error {
+		return findURL(tx, urlKey(id), active, result)
+	})
+}
+
+// FindAlias finds a short URL by its alias.
+func (bs *Bolt) FindAlias(ctx context.Context, alias string, active bool, result interface{}) error {
+	return bs.view(ctx, func(tx *bbolt.Tx) error {
+		key := bucket(tx, "aliases").Get([]byte(alias))
+		if key == nil {
+			return ErrNotFound
+		}
+		return findURL(tx, key, active, result)
+	})
+}
+
+// maxURL returns max sequential short URL identifier from the transaction.
+func maxURL(tx *bbolt.Tx) (int64, error) {
+	c := bucket(tx, "urls").Cursor()
+	k, data := c.Seek(urlKey(RandomMin))
+	if k == nil {
+		k, data = c.Last()
+	} else {
+		k, data = c.Prev()
+	}
+	if k == nil {
+		return 0, nil
+	}
+	item := &ItemURL{}
+	if err := bson.Unmarshal(data, item); err != nil {
+		return 0, err
+	}
+	return item.ID, nil
+}
+
+// MaxURL returns max sequential short URL identifier.
+func (bs *Bolt) MaxURL(ctx context.Context) (int64, error) {
+	var id int64
+	err := bs.view(ctx, func(tx *bbolt.Tx) error {
+		var err error
+		id, err = maxURL(tx)
+		return err
+	})
+	return id, err
+}
+
+// reserveURLs moves short URLs counter forward using a function of its current value,
+// the counter starts from max short URL identifier.
+func (bs *Bolt) reserveURLs(ctx context.Context, next func(seq int64) int64) (int64, error) {
+	var seq int64
+	err := bs.update(ctx, func(tx *bbolt.Tx) error {
+		b := bucket(tx, "counters")
+		key := []byte(urlCounter)
+		if data := b.Get(key); data != nil {
+			seq = int64(binary.BigEndian.Uint64(data))
+		} else {
+			id, err := maxURL(tx)
+			if err != nil {
+				return err
+			}
+			seq = id
+		}
+		seq = next(seq)
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(seq))
+		return b.Put(key, value)
+	})
+	return seq, err
+}
+
+// ReserveURLs reserves n identifiers for new short URLs.
+func (bs *Bolt) ReserveURLs(ctx context.Context, n int) (int64, error) {
+	return bs.reserveURLs(ctx, func(seq int64) int64 {
+		return seq + int64(n)
+	})
+}
+
+// SyncURLs moves short URLs counter forward to id.
+func (bs *Bolt) SyncURLs(ctx context.Context, id int64) error {
+	_, err := bs.reserveURLs(ctx, func(seq int64) int64 {
+		if id > seq {
+			return id
+		}
+		return seq
+	})
+	return err
+}
+
+// LeaseURLs reserves a block of n identifiers for the node.
+func (bs *Bolt) LeaseURLs(ctx context.Context, node string, n int) (*Lease, error) {
+	hi, err := bs.ReserveURLs(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+	lease := &Lease{Node: node, Lo: hi - int64(n) + 1, Hi: hi, Created: time.Now().UTC()}
+	data, err := bson.Marshal(lease)
+	if err != nil {
+		return nil, err
+	}
+	err = bs.update(ctx, func(tx *bbolt.Tx) error {
+		return bucket(tx, "leases").Put([]byte(node), data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+// FindLease returns a current lease of the node.
+func (bs *Bolt) FindLease(ctx context.Context, node string) (*Lease, error) {
+	lease := &Lease{}
+	err := bs.view(ctx, func(tx *bbolt.Tx) error {
+		data := bucket(tx, "leases").Get([]byte(node))
+		if data == nil {
+			return ErrNotFound
+		}
+		return bson.Unmarshal(data, lease)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+// IsLeased checks that the identifier is inside of some node's lease.
+func (bs *Bolt) IsLeased(ctx context.Context, id int64) (bool, error) {
+	var found bool
+	err := bs.view(ctx, func(tx *bbolt.Tx) error {
+		return bucket(tx, "leases").ForEach(func(k, data []byte) error {
+			lease := &Lease{}
+			if err := bson.Unmarshal(data, lease); err != nil {
+				return err
+			}
+			if lease.Lo <= id && id <= lease.Hi {
+				found = true
+			}
+			return nil
+		})
+	})
+	return found, err
+}
+
+// MaxURLIn returns max short URL identifier from the range.
+func (bs *Bolt) MaxURLIn(ctx context.Context, lo, hi int64) (int64, error) {
+	id := lo - 1
+	err := bs.view(ctx, func(tx *bbolt.Tx) error {
+		c := bucket(tx, "urls").Cursor()
+		k, _ := c.Seek(urlKey(hi))
+		switch {
+		case k == nil:
+			k, _ = c.Last()
+		case bytes.Compare(k, urlKey(hi)) > 0:
+			k, _ = c.Prev()
+		}
+		if k != nil && bytes.Compare(k, urlKey(lo)) >= 0 {
+			id = int64(binary.BigEndian.Uint64(k) ^ (1 << 63))
+		}
+		return nil
+	})
+	return id, err
+}
+
+// filterURLs calls fn for every short URL satisfied to the condition,
+// short URLs are read in descending order of identifiers.
+func (bs *Bolt) filterURLs(ctx context.Context, condition func(u *boltURL) bool, fn func(data []byte) bool) error {
+	return bs.view(ctx, func(tx *bbolt.Tx) error {
+		c := bucket(tx, "urls").Cursor()
+		for k, data := c.Last(); k != nil; k, data = c.Prev() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			u := &boltURL{}
+			if err := bson.Unmarshal(data, u); err != nil {
+				return err
+			}
+			if condition(u) && !fn(data) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// CountURLs returns a number of filtered short URLs.
+func (bs *Bolt) CountURLs(ctx context.Context, f *Filter) (int, error) {
+	var n int
+	err := bs.filterURLs(ctx, f.match, func(data []byte) bool {
+		n++
+		return true
+	})
+	return n, err
+}
+
+// FilterURLs returns an iterator of filtered short URLs.
+func (bs *Bolt) FilterURLs(ctx context.Context, f *Filter, skip, limit int) Iter {
+	iter := &boltIter{}
+	iter.err = bs.filterURLs(ctx, f.match, func(data []byte) bool {
+		if skip > 0 {
+			skip--
+			return true
+		}
+		iter.docs = append(iter.docs, append([]byte(nil), data...))
+		return len(iter.docs) < limit
+	})
+	return iter
+}
+
+// ScanURLs returns an iterator of active short URLs with identifiers greater than after.
+func (bs *Bolt) ScanURLs(ctx context.Context, after int64, limit int) Iter {
+	iter := &boltIter{}
+	iter.err = bs.view(ctx, func(tx *bbolt.Tx) error {
+		c := bucket(tx, "urls").Cursor()
+		for k, data := c.Seek(urlKey(after)); k != nil && len(iter.docs) < limit; k, data = c.Next() {
+			u := &boltURL{}
+			if err := bson.Unmarshal(data, u); err != nil {
+				return err
+			}
+			if u.ID > after && !u.Disabled {
+				iter.docs = append(iter.docs, append([]byte(nil), data...))
+			}
+		}
+		return nil
+	})
+	return iter
+}
+
+// CountSpam returns numbers of all user's short URLs and spam ones.
+func (bs *Bolt) CountSpam(ctx context.Context, user string, min float64) (int, int, error) {
+	var total, n int
+	err := bs.filterURLs(ctx, func(u *boltURL) bool {
+		return u.User == user
+	}, func(data []byte) bool {
+		u := &boltURL{}
+		if bson.Unmarshal(data, u) == nil && u.Spam > min {
+			n++
+		}
+		total++
+		return true
+	})
+	return total, n, err
+}
+
+// DuplicateURLs returns an iterator of active short URLs with the same
+// normalized original URL, author and group.
+func (bs *Bolt) DuplicateURLs(ctx context.Context, norm, user, group string) Iter {
+	iter := &boltIter{}
+	duplicate := func(u *boltURL) bool {
+		return !u.Disabled && u.Norm == norm && u.User == user && u.Group == group
+	}
+	iter.err = bs.filterURLs(ctx, duplicate, func(data []byte) bool {
+		iter.docs = append(iter.docs, append([]byte(nil), data...))
+		return true
+	})
+	return iter
+}
+
+// ExpiredURLs returns an iterator of active expired short URLs.
+func (bs *Bolt) ExpiredURLs(ctx context.Context, t time.Time) Iter {
+	iter := &boltIter{}
+	expired := func(u *boltURL) bool {
+		return !u.Disabled && u.TTL != nil && u.TTL.Before(t)
+	}
+	iter.err = bs.filterURLs(ctx, expired, func(data []byte) bool {
+		iter.docs = append(iter.docs, append([]byte(nil), data...))
+		return true
+	})
+	return iter
+}
+
+// UpdateURL sets new values of short URL's fields.
+func (bs *Bolt) UpdateURL(ctx context.Context, id int64, set map[string]interface{}) error {
+	return bs.update(ctx, func(tx *bbolt.Tx) error {
+		return setFields(bucket(tx, "urls"), urlKey(id), bson.M(set))
+	})
+}
+
+// ClickURL atomically decreases a number of left redirects of active short URL.
+func (bs *Bolt) ClickURL(ctx context.Context, id int64) (int64, error) {
+	var left int64
+	err := bs.update(ctx, func(tx *bbolt.Tx) error {
+		b, key := bucket(tx, "urls"), urlKey(id)
+		data := b.Get(key)
+		if data == nil {
+			return ErrNotFound
+		}
+		u := &boltURL{}
+		if err := bson.Unmarshal(data, u); err != nil {
+			return err
+		}
+		if u.Disabled || u.Left < 1 {
+			return ErrNotFound
+		}
+		left = u.Left - 1
+		set := bson.M{"left": left}
+		if left == 0 {
+			set["off"], set["why"] = true, OffClicks
+		}
+		return setFields(b, key, set)
+	})
+	return left, err
+}
+
+// DisableURL deactivates a short URL with the reason.
+func (bs *Bolt) DisableURL(ctx context.Context, id int64, reason string) error {
+	return bs.update(ctx, func(tx *bbolt.Tx) error {
+		return setFields(bucket(tx, "urls"), urlKey(id), bson.M{"off": true, "why": reason})
+	})
+}
+
+// DisableExpired deactivates all expired short URLs.
+func (bs *Bolt) DisableExpired(ctx context.Context, t time.Time) (int, error) {
+	var n int
+	iter := bs.ExpiredURLs(ctx, t)
+	u := &boltURL{}
+	for iter.Next(u) {
+		if err := bs.DisableURL(ctx, u.ID, OffExpired); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, iter.Close()
+}
+
+// RemoveURLs deletes short URLs that were moved to trash before t.
+func (bs *Bolt) RemoveURLs(ctx context.Context, t time.Time) (int, error) {
+	var n int
+	err := bs.update(ctx, func(tx *bbolt.Tx) error {
+		b, ab := bucket(tx, "urls"), bucket(tx, "aliases")
+		removed := make(map[string]string)
+		err := b.ForEach(func(k, data []byte) error {
+			u := &boltURL{}
+			if err := bson.Unmarshal(data, u); err != nil {
+				return err
+			}
+			if u.Deleted != nil && u.Deleted.Before(t) {
+				removed[string(k)] = u.Alias
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for k, alias := range removed {
+			if alias != "" {
+				if err := ab.Delete([]byte(alias)); err != nil {
+					return err
+				}
+			}
+			if err := b.Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+		n = len(removed)
+		return nil
+	})
+	return n, err
+}
+
+// InsertUser saves new user.
+func (bs *Bolt) InsertUser(ctx context.Context, doc interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	u := &boltUser{}
+	if err := bson.Unmarshal(data, u); err != nil {
+		return err
+	}
+	return bs.update(ctx, func(tx *bbolt.Tx) error {
+		b := bucket(tx, "users")
+		if b.Get([]byte(u.Name)) != nil {
+			return ErrDuplicate
+		}
+		return b.Put([]byte(u.Name), data)
+	})
+}
+
+// FindUser finds an active user by token.
+func (bs *Bolt) FindUser(ctx context.Context, token string, result interface{}) error {
+	return bs.view(ctx, func(tx *bbolt.Tx) error {
+		c := bucket(tx, "users").Cursor()
+		for k, data := c.First(); k != nil; k, data = c.Next() {
+			u := &boltUser{}
+			if err := bson.Unmarshal(data, u); err != nil {
+				return err
+			}
+			if !u.Disabled && u.Token == token {
+				return bson.Unmarshal(data, result)
+			}
+		}
+		return ErrNotFound
+	})
+}
+
+// UpdateToken changes user's token.
+func (bs *Bolt) UpdateToken(ctx context.Context, name, token string, t time.Time) error {
+	return bs.update(ctx, func(tx *bbolt.Tx) error {
+		return setFields(bucket(tx, "users"), []byte(name), bson.M{"token": token, "mt": t})
+	})
+}
+
+// DisableUser deactivates user's account.
+func (bs *Bolt) DisableUser(ctx context.Context, name string, t time.Time) error {
+	return bs.update(ctx, func(tx *bbolt.Tx) error {
+		b := bucket(tx, "users")
+		data := b.Get([]byte(name))
+		if data == nil {
+			return ErrNotFound
+		}
+		u := &boltUser{}
+		if err := bson.Unmarshal(data, u); err != nil {
+			return err
+		}
+		if u.Disabled {
+			return ErrNotFound
+		}
+		return setFields(b, []byte(name), bson.M{"off": true, "mt": t})
+	})
+}
+
+// InsertTrack saves info about a request.
+func (bs *Bolt) InsertTrack(ctx context.Context, doc interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bs.update(ctx, func(tx *bbolt.Tx) error {
+		b := bucket(tx, "tracks")
+		key, err := trackKey(b, data)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, data)
+	})
+}
+
+// lock changes the lock if check function allows it.
+func (bs *Bolt) lock(ctx context.Context, key string, check func(l *Lock) error, change func(l *Lock) *Lock) error {
+	return bs.update(ctx, func(tx *bbolt.Tx) error {
+		b := bucket(tx, "locks")
+		var current *Lock
+		if data := b.Get([]byte(key)); data != nil {
+			current = &Lock{}
+			if err := bson.Unmarshal(data, current); err != nil {
+				return err
+			}
+		}
+		if err := check(current); err != nil {
+			return err
+		}
+		l := change(current)
+		if l == nil {
+			return b.Delete([]byte(key))
+		}
+		data, err := bson.Marshal(l)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+// AcquireLock takes the lock for the owner during ttl.
+func (bs *Bolt) AcquireLock(ctx context.Context, key, owner string, ttl time.Duration) error {
+	now := time.Now().UTC()
+	check := func(l *Lock) error {
+		if l != nil && l.Owner != owner && !l.Expire.Before(now) {
+			return ErrLocked
+		}
+		return nil
+	}
+	return bs.lock(ctx, key, check, func(l *Lock) *Lock {
+		return &Lock{Key: key, Owner: owner, Expire: now.Add(ttl)}
+	})
+}
+
+// RenewLock prolongs owner's lock for ttl.
+func (bs *Bolt) RenewLock(ctx context.Context, key, owner string, ttl time.Duration) error {
+	check := func(l *Lock) error {
+		if l == nil || l.Owner != owner {
+			return ErrLocked
+		}
+		return nil
+	}
+	return bs.lock(ctx, key, check, func(l *Lock) *Lock {
+		l.Expire = time.Now().UTC().Add(ttl)
+		return l
+	})
+}
+
+// ReleaseLock releases owner's lock.
+func (bs *Bolt) ReleaseLock(ctx context.Context, key, owner string) error {
+	var other bool
+	check := func(l *Lock) error {
+		other = l != nil && l.Owner != owner
+		return nil
+	}
+	return bs.lock(ctx, key, check, func(l *Lock) *Lock {
+		if other {
+			return l
+		}
+		return nil
+	})
+}
+
+// AddTest saves new test item.
+func (bs *Bolt) AddTest(ctx context.Context, t time.Time) error {
+	data, err := bson.Marshal(bson.M{"ts": t})
+	if err != nil {
+		return err
+	}
+	return bs.update(ctx, func(tx *bbolt.Tx) error {
+		b := bucket(tx, "tests")
+		key, err := seqKey(b)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, data)
+	})
+}
+
+// RemoveTest removes one test item.
+func (bs *Bolt) RemoveTest(ctx context.Context) error {
+	return bs.update(ctx, func(tx *bbolt.Tx) error {
+		b := bucket(tx, "tests")
+		k, _ := b.Cursor().First()
+		if k == nil {
+			return ErrNotFound
+		}
+		return b.Delete(k)
+	})
+}
+
+// CountTests returns a number of test items.
+func (bs *Bolt) CountTests(ctx context.Context) (int, error) {
+	var n int
+	err := bs.view(ctx, func(tx *bbolt.Tx) error {
+		n = bucket(tx, "tests").Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+// SchemaVersion returns a version of last applied migration, zero for new storage.
+func (bs *Bolt) SchemaVersion(ctx context.Context) (int, error) {
+	last := &Migration{}
+	err := bs.view(ctx, func(tx *bbolt.Tx) error {
+		_, data := bucket(tx, "migrations").Cursor().Last()
+		if data == nil {
+			return nil
+		}
+		return bson.Unmarshal(data, last)
+	})
+	return last.Version, err
+}
+
+// SaveMigration marks the migration as applied.
+func (bs *Bolt) SaveMigration(ctx context.Context, m *Migration) error {
+	data, err := bson.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return bs.update(ctx, func(tx *bbolt.Tx) error {
+		b := bucket(tx, "migrations")
+		key := urlKey(int64(m.Version))
+		if b.Get(key) != nil {
+			return ErrDuplicate
+		}
+		return b.Put(key, data)
+	})
+}
+
+// RollupTracks adds old tracks to daily aggregates in one transaction.
+func (bs *Bolt) RollupTracks(ctx context.Context, t time.Time, archive bool) (int, error) {
+	var n int
+	err := bs.update(ctx, func(tx *bbolt.Tx) error {
+		b, rb, ab := bucket(tx, "tracks"), bucket(tx, "rollups"), bucket(tx, "archive")
+		keys, r := [][]byte{}, rollups{}
+		err := b.ForEach(func(k, data []byte) error {
+			item := &trackItem{}
+			if err := bson.Unmarshal(data, item); err != nil {
+				return err
+			}
+			if !item.Created.Before(t) {
+				return nil
+			}
+			r.add(item)
+			keys = append(keys, k)
+			if archive {
+				key, err := seqKey(ab)
+				if err != nil {
+					return err
+				}
+				return ab.Put(key, data)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		for id, item := range r {
+			if data := rb.Get([]byte(id)); data != nil {
+				saved := &Rollup{}
+				if err := bson.Unmarshal(data, saved); err != nil {
+					return err
+				}
+				item.Count += saved.Count
+			}
+			data, err := bson.Marshal(item)
+			if err != nil {
+				return err
+			}
+			if err := rb.Put([]byte(id), data); err != nil {
+				return err
+			}
+		}
+		n = len(keys)
+		return nil
+	})
+	return n, err
+}
+
+// DumpDocs calls fn for every BSON document of the collection.
+func (bs *Bolt) DumpDocs(ctx context.Context, name string, fn func(doc []byte) error) error {
+	return bs.view(ctx, func(tx *bbolt.Tx) error {
+		return bucket(tx, name).ForEach(func(k, data []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return fn(data)
+		})
+	})
+}
+
+// trackKey returns a key of the track, it's the track's ObjectId,
+// so the same track is saved only once. Tracks without it get a sequence number.
+func trackKey(b *bbolt.Bucket, doc []byte) ([]byte, error) {
+	if id, ok := bson.Raw(doc).Lookup("_id").ObjectIDOK(); ok {
+		return id[:], nil
+	}
+	return seqKey(b)
+}
+
+// restoreKey returns a key of restored document by its identifier.
+func restoreKey(b *bbolt.Bucket, name string, doc []byte) ([]byte, error) {
+	switch name {
+	case "users":
+		u := &boltUser{}
+		if err := bson.Unmarshal(doc, u); err != nil {
+			return nil, err
+		}
+		return []byte(u.Name), nil
+	case "rollups":
+		r := &Rollup{}
+		if err := bson.Unmarshal(doc, r); err != nil {
+			return nil, err
+		}
+		return []byte(r.ID), nil
+	}
+	return trackKey(b, doc)
+}
+
+// RestoreDocs saves BSON documents to the collection, existing ones are replaced.
+func (bs *Bolt) RestoreDocs(ctx context.Context, name string, docs [][]byte) error {
+	return bs.update(ctx, func(tx *bbolt.Tx) error {
+		b := bucket(tx, name)
+		for _, doc := range docs {
+			if name == "urls" {
+				if err := putURL(tx, doc, true); err != nil {
+					return err
+				}
+				continue
+			}
+			key, err := restoreKey(b, name, doc)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(key, doc); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,585 @@
+// Copyright 2016 Alexander Zaytsev <thebestzorro@yandex.ru>
+// Use of this source code is governed by a GPL-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/z0rr0/luss/conf"
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type testURL struct {
+	ID       int64      `bson:"_id"`
+	Alias    string     `bson:"alias,omitempty"`
+	Disabled bool       `bson:"off"`
+	Group    string     `bson:"group"`
+	Tag      string     `bson:"tag"`
+	Original string     `bson:"orig"`
+	Norm     string     `bson:"norm,omitempty"`
+	User     string     `bson:"u"`
+	TTL      *time.Time `bson:"ttl"`
+	Deleted  *time.Time `bson:"del,omitempty"`
+	Left     int64      `bson:"left,omitempty"`
+	Spam     float64    `bson:"spam"`
+	Reason   string     `bson:"why,omitempty"`
+	Created  time.Time  `bson:"ts"`
+}
+
+type testUser struct {
+	Name     string `bson:"_id"`
+	Disabled bool   `bson:"off"`
+	Token    string `bson:"token"`
+}
+
+func testBolt(t *testing.T) (*Bolt, func()) {
+	dir, err := ioutil.TempDir("", "luss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &conf.Conn{Storage: &conf.StorageCfg{Engine: conf.BoltEngine, File: filepath.Join(dir, "luss.db")}}
+	bs, err := NewBolt(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bs, func() {
+		c.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltURLs(t *testing.T) {
+	bs, cleanup := testBolt(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	if n, err := bs.MaxURL(ctx); err != nil || n != 0 {
+		t.Errorf("invalid behavior: %v, %v", n, err)
+	}
+	now := time.Now().UTC()
+	expired := now.Add(-time.Hour)
+	docs := []interface{}{
+		&testURL{ID: 1, Group: "g", Original: "http://a", Created: now},
+		&testURL{ID: 2, Group: "g", Original: "http://b", Created: now, TTL: &expired},
+		&testURL{ID: 3, Original: "http://c", Created: now},
+	}
+	if err := bs.InsertURLs(ctx, docs...); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.InsertURLs(ctx, &testURL{ID: 2}); err != ErrDuplicate {
+		t.Errorf("invalid behavior: %v", err)
+	}
+	// random short URLs don't change sequence
+	if err := bs.InsertURLs(ctx, &testURL{ID: RandomMin + 1}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := bs.MaxURL(ctx); err != nil || n != 3 {
+		t.Errorf("invalid behavior: %v, %v", n, err)
+	}
+	if n, err := bs.ReserveURLs(ctx, 2); err != nil || n != 5 {
+		t.Errorf("invalid behavior: %v, %v", n, err)
+	}
+	if err := bs.SyncURLs(ctx, 10); err != nil {
+		t.Error(err)
+	}
+	if err := bs.SyncURLs(ctx, 7); err != nil {
+		t.Error(err)
+	}
+	if n, err := bs.ReserveURLs(ctx, 1); err != nil || n != 11 {
+		t.Errorf("invalid behavior: %v, %v", n, err)
+	}
+	u := &testURL{}
+	if err := bs.FindURL(ctx, 2, true, u); err != nil || u.Original != "http://b" {
+		t.Errorf("invalid behavior: %v, %v", u, err)
+	}
+	if err := bs.UpdateURL(ctx, 3, map[string]interface{}{"orig": "http://d", "tag": "t"}); err != nil {
+		t.Error(err)
+	}
+	if err := bs.FindURL(ctx, 3, true, u); err != nil || u.Original != "http://d" || u.Tag != "t" {
+		t.Errorf("invalid behavior: %v, %v", u, err)
+	}
+	if err := bs.UpdateURL(ctx, 100, map[string]interface{}{"tag": "t"}); err != ErrNotFound {
+		t.Errorf("invalid behavior: %v", err)
+	}
+	if err := bs.FindURL(ctx, 4, false, u); err != ErrNotFound {
+		t.Errorf("invalid behavior: %v", err)
+	}
+	f := &Filter{Group: "g", Active: true}
+	if n, err := bs.CountURLs(ctx, f); err != nil || n != 2 {
+		t.Errorf("invalid behavior: %v, %v", n, err)
+	}
+	iter := bs.FilterURLs(ctx, f, 1, 10)
+	for iter.Next(u) {
+		if u.ID != 1 {
+			t.Errorf("invalid behavior: %v", u.ID)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		t.Error(err)
+	}
+	if n, err := bs.DisableExpired(ctx, now); err != nil || n != 1 {
+		t.Errorf("invalid behavior: %v, %v", n, err)
+	}
+	if err := bs.FindURL(ctx, 2, true, u); err != ErrNotFound {
+		t.Errorf("invalid behavior: %v", err)
+	}
+	if n, err := bs.CountURLs(ctx, f); err != nil || n != 1 {
+		t.Errorf("invalid behavior: %v, %v", n, err)
+	}
+}
+
+func TestBoltAliases(t *testing.T) {
+	bs, cleanup := testBolt(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	docs := []interface{}{
+		&testURL{ID: 1, Alias: "my-link", Original: "http://a"},
+		&testURL{ID: 2, Original: "http://b"},
+	}
+	if err := bs.InsertURLs(ctx, docs...); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.InsertURLs(ctx, &testURL{ID: 3, Alias: "my-link"}); err != ErrDuplicate {
+		t.Errorf("invalid behavior: %v", err)
+	}
+	if err := bs.FindURL(ctx, 3, false, &testURL{}); err != ErrNotFound {
+		t.Errorf("invalid behavior: %v", err)
+	}
+	u := &testURL{}
+	if err := bs.FindAlias(ctx, "my-link", true, u); err != nil || u.ID != 1 {
+		t.Errorf("invalid behavior: %v, %v", u, err)
+	}
+	if err := bs.FindAlias(ctx, "unknown", false, u); err != ErrNotFound {
+		t.Errorf("invalid behavior: %v", err)
+	}
+	if err := bs.DisableURL(ctx, 1, OffSpam); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.FindAlias(ctx, "my-link", true, u); err != ErrNotFound {
+		t.Errorf("invalid behavior: %v", err)
+	}
+	if err := bs.FindAlias(ctx, "my-link", false, u); err != nil || !u.Disabled {
+		t.Errorf("invalid behavior: %v, %v", u, err)
+	}
+	// trash cleaning
+	deleted := time.Now().UTC()
+	if err := bs.UpdateURL(ctx, 1, map[string]interface{}{"del": deleted}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := bs.RemoveURLs(ctx, deleted.Add(-time.Hour)); err != nil || n != 0 {
+		t.Errorf("invalid behavior: %v, %v", n, err)
+	}
+	if n, err := bs.RemoveURLs(ctx, deleted.Add(time.Second)); err != nil || n != 1 {
+		t.Errorf("invalid behavior: %v, %v", n, err)
+	}
+	if err := bs.FindAlias(ctx, "my-link", false, u); err != ErrNotFound {
+		t.Errorf("invalid behavior: %v", err)
+	}
+	if err := bs.InsertURLs(ctx, &testURL{ID: 5, Alias: "my-link"}); err != nil {
+		t.Errorf("invalid behavior: %v", err)
+	}
+}
+
+func TestBoltDuplicates(t *testing.T) {
+	bs, cleanup := testBolt(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	docs := []interface{}{
+		&testURL{ID: 1, Norm: "http://a/", User: "u1", Group: "g"},
+		&testURL{ID: 2, Norm: "http://a/", User: "u2", Group: "g"},
+		&testURL{ID: 3, Norm: "http://a/", User: "u1", Group: "g", Disabled: true},
+		&testURL{ID: 4, Norm: "http://b/", User: "u1", Group: "g"},
+	}
+	if err := bs.InsertURLs(ctx, docs...); err != nil {
+		t.Fatal(err)
+	}
+	var found []int64
+	u := &testURL{}
+	iter := bs.DuplicateURLs(ctx, "http://a/", "u1", "g")
+	for iter.Next(u) {
+		found = append(found, u.ID)
+	}
+	if err := iter.Close(); err != nil {
+		t.Error(err)
+	}
+	if len(found) != 1 || found[0] != 1 {
+		t.Errorf("invalid behavior: %v", found)
+	}
+}
+
+func TestBoltClicks(t *testing.T) {
+	bs, cleanup := testBolt(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	if err := bs.InsertURLs(ctx, &testURL{ID: 1, Left: 2}, &testURL{ID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := bs.ClickURL(ctx, 2); err != ErrNotFound {
+		t.Errorf("invalid behavior: %v, %v", n, err)
+	}
+	for _, left := range []int64{1, 0} {
+		if n, err := bs.ClickURL(ctx, 1); err != nil || n != left {
+			t.Errorf("invalid behavior: %v, %v", n, err)
+		}
+	}
+	if n, err := bs.ClickURL(ctx, 1); err != ErrNotFound {
+		t.Errorf("invalid behavior: %v, %v", n, err)
+	}
+	if err := bs.FindURL(ctx, 1, true, &testURL{}); err != ErrNotFound {
+		t.Errorf("invalid behavior: %v", err)
+	}
+	u := &testURL{}
+	if err := bs.FindURL(ctx, 1, false, u); err != nil || u.Reason != OffClicks {
+		t.Errorf("invalid behavior: %v, %v", u, err)
+	}
+}
+
+func TestBoltSpam(t *testing.T) {
+	bs, cleanup := testBolt(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	docs := []interface{}{
+		&testURL{ID: 1, User: "u1", Spam: 10},
+		&testURL{ID: 2, User: "u1", Spam: 90},
+		&testURL{ID: 3, User: "u1", Spam: 50, Disabled: true},
+		&testURL{ID: 4, User: "u2", Spam: 90},
+		&testURL{ID: 5, User: "u1"},
+	}
+	if err := bs.InsertURLs(ctx, docs...); err != nil {
+		t.Fatal(err)
+	}
+	total, n, err := bs.CountSpam(ctx, "u1", 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 4 || n != 2 {
+		t.Errorf("invalid behavior: %v, %v", total, n)
+	}
+	var found []int64
+	u := &testURL{}
+	iter := bs.ScanURLs(ctx, 1, 2)
+	for iter.Next(u) {
+		found = append(found, u.ID)
+	}
+	if err := iter.Close(); err != nil {
+		t.Error(err)
+	}
+	if len(found) != 2 || found[0] != 2 || found[1] != 4 {
+		t.Errorf("invalid behavior: %v", found)
+	}
+}
+
+func TestBoltUsers(t *testing.T) {
+	bs, cleanup := testBolt(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	if err := bs.InsertUser(ctx, &testUser{Name: "user", Token: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.InsertUser(ctx, &testUser{Name: "user"}); err != ErrDuplicate {
+		t.Errorf("invalid behavior: %v", err)
+	}
+	if err := bs.UpdateToken(ctx, "user", "xyz", now); err != nil {
+		t.Error(err)
+	}
+	if err := bs.UpdateToken(ctx, "bad", "xyz", now); err != ErrNotFound {
+		t.Errorf("invalid behavior: %v", err)
+	}
+	u := &testUser{}
+	if err := bs.FindUser(ctx, "xyz", u); err != nil || u.Name != "user" {
+		t.Errorf("invalid behavior: %v, %v", u, err)
+	}
+	if err := bs.DisableUser(ctx, "user", now); err != nil {
+		t.Error(err)
+	}
+	if err := bs.DisableUser(ctx, "user", now); err != ErrNotFound {
+		t.Errorf("invalid behavior: %v", err)
+	}
+	if err := bs.FindUser(ctx, "xyz", u); err != ErrNotFound {
+		t.Errorf("invalid behavior: %v", err)
+	}
+}
+
+func TestBoltLock(t *testing.T) {
+	bs, cleanup := testBolt(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	if err := bs.AcquireLock(ctx, "key", "owner1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.AcquireLock(ctx, "key", "owner2", time.Minute); err != ErrLocked {
+		t.Errorf("invalid behavior: %v", err)
+	}
+	if err := bs.RenewLock(ctx, "key", "owner2", time.Minute); err != ErrLocked {
+		t.Errorf("invalid behavior: %v", err)
+	}
+	if err := bs.RenewLock(ctx, "key", "owner1", -time.Minute); err != nil {
+		t.Error(err)
+	}
+	// stale lock is taken over
+	if err := bs.AcquireLock(ctx, "key", "owner2", time.Minute); err != nil {
+		t.Error(err)
+	}
+	if err := bs.ReleaseLock(ctx, "key", "owner1"); err != nil {
+		t.Error(err)
+	}
+	if err := bs.AcquireLock(ctx, "key", "owner1", time.Minute); err != ErrLocked {
+		t.Errorf("invalid behavior: %v", err)
+	}
+	if err := bs.ReleaseLock(ctx, "key", "owner2"); err != nil {
+		t.Error(err)
+	}
+	if err := bs.AcquireLock(ctx, "key", "owner1", time.Minute); err != nil {
+		t.Error(err)
+	}
+	if err := bs.AddTest(ctx, time.Now()); err != nil {
+		t.Error(err)
+	}
+	if n, err := bs.CountTests(ctx); err != nil || n != 1 {
+		t.Errorf("invalid behavior: %v, %v", n, err)
+	}
+	if err := bs.RemoveTest(ctx); err != nil {
+		t.Error(err)
+	}
+	if err := bs.RemoveTest(ctx); err != ErrNotFound {
+		t.Errorf("invalid behavior: %v", err)
+	}
+}
+
+func TestBoltMigrate(t *testing.T) {
+	bs, cleanup := testBolt(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	if v, err := bs.SchemaVersion(ctx); err != nil || v != 0 {
+		t.Errorf("invalid behavior: %v, %v", v, err)
+	}
+	n, err := Migrate(ctx, bs, "owner", time.Minute)
+	if err != nil || n != len(Migrations) {
+		t.Errorf("invalid behavior: %v, %v", n, err)
+	}
+	if v, err := bs.SchemaVersion(ctx); err != nil || v != Migrations[len(Migrations)-1].Version {
+		t.Errorf("invalid behavior: %v, %v", v, err)
+	}
+	if n, err := Migrate(ctx, bs, "owner", time.Minute); err != nil || n != 0 {
+		t.Errorf("invalid behavior: %v, %v", n, err)
+	}
+	if err := bs.SaveMigration(ctx, Migrations[0]); err != ErrDuplicate {
+		t.Errorf("invalid behavior: %v", err)
+	}
+	if err := bs.AcquireLock(ctx, "migrations", "other", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Migrate(ctx, bs, "owner", time.Minute); err != ErrLocked {
+		t.Errorf("invalid behavior: %v", err)
+	}
+}
+
+func TestBoltKeepLock(t *testing.T) {
+	bs, cleanup := testBolt(t)
+	defer cleanup()
+	ctx := context.Background()
+	ttl := 30 * time.Millisecond
+
+	if err := bs.AcquireLock(ctx, "key", "owner", ttl); err != nil {
+		t.Fatal(err)
+	}
+	runCtx, stop := keepLock(ctx, bs, "key", "owner", ttl)
+	time.Sleep(3 * ttl)
+	// the lock is renewed during long work
+	if err := bs.AcquireLock(ctx, "key", "other", ttl); err != ErrLocked {
+		t.Errorf("invalid behavior: %v", err)
+	}
+	if err := stop(); err != nil || runCtx.Err() == nil {
+		t.Errorf("invalid behavior: %v", err)
+	}
+	// lost lock cancels the work
+	runCtx, stop = keepLock(ctx, bs, "key", "owner", ttl)
+	if err := bs.ReleaseLock(ctx, "key", "owner"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.AcquireLock(ctx, "key", "other", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-runCtx.Done():
+	case <-time.After(time.Second):
+		t.Error("invalid behavior")
+	}
+	if err := stop(); err == nil {
+		t.Error("invalid behavior")
+	}
+}
+
+func TestBoltRollup(t *testing.T) {
+	bs, cleanup := testBolt(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	day := time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)
+	tracks := []bson.M{
+		{"short": "a", "geo": bson.M{"country": "RU", "city": "Moscow"}, "ts": day},
+		{"short": "a", "geo": bson.M{"country": "RU", "city": "Moscow"}, "ts": day.Add(time.Hour)},
+		{"short": "a", "geo": bson.M{"country": "RU", "city": "Tver"}, "ts": day},
+		{"short": "b", "geo": bson.M{}, "ts": day.AddDate(0, 0, 1)},
+		{"short": "a", "geo": bson.M{}, "ts": day.AddDate(0, 0, 5)},
+	}
+	for _, track := range tracks {
+		if err := bs.InsertTrack(ctx, track); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := bs.RollupTracks(ctx, day.AddDate(0, 0, 2), true); err != nil || n != 4 {
+		t.Errorf("invalid behavior: %v, %v", n, err)
+	}
+	if err := bs.InsertTrack(ctx, tracks[0]); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := bs.RollupTracks(ctx, day.AddDate(0, 0, 2), false); err != nil || n != 1 {
+		t.Errorf("invalid behavior: %v, %v", n, err)
+	}
+	err := bs.DB.View(func(tx *bbolt.Tx) error {
+		if n := bucket(tx, "tracks").Stats().KeyN; n != 1 {
+			t.Errorf("invalid behavior: %v", n)
+		}
+		if n := bucket(tx, "archive").Stats().KeyN; n != 4 {
+			t.Errorf("invalid behavior: %v", n)
+		}
+		if n := bucket(tx, "rollups").Stats().KeyN; n != 3 {
+			t.Errorf("invalid behavior: %v", n)
+		}
+		r := &Rollup{}
+		if err := bson.Unmarshal(bucket(tx, "rollups").Get([]byte("2016-10-01:a:RU:Moscow")), r); err != nil {
+			return err
+		}
+		if r.Count != 3 || !r.Day.Equal(day.Truncate(24*time.Hour)) {
+			t.Errorf("invalid behavior: %v", r)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBoltBackup(t *testing.T) {
+	bs, cleanup := testBolt(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	docs := []interface{}{
+		&testURL{ID: 1, Original: "http://a", Created: now},
+		&testURL{ID: 40, Group: "g", Original: "http://b", Created: now, TTL: &now},
+	}
+	if err := bs.InsertURLs(ctx, docs...); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.InsertUser(ctx, &testUser{Name: "user", Token: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.InsertTrack(ctx, bson.M{"short": "1", "ts": now}); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	result, err := Backup(ctx, bs, buf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result["urls"] != 2 || result["users"] != 1 || result["tracks"] != 0 {
+		t.Errorf("invalid behavior: %v", result)
+	}
+	// aggregates are saved always, raw tracks are optional
+	if _, err := bs.RollupTracks(ctx, now.Add(time.Hour), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.InsertTrack(ctx, bson.M{"_id": primitive.NewObjectID(), "short": "1", "ts": now}); err != nil {
+		t.Fatal(err)
+	}
+	tracksBuf := &bytes.Buffer{}
+	result, err = Backup(ctx, bs, tracksBuf, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result["rollups"] != 1 || result["tracks"] != 1 {
+		t.Errorf("invalid behavior: %v", result)
+	}
+
+	restored, cleanupRestored := testBolt(t)
+	defer cleanupRestored()
+	result, err = Restore(ctx, restored, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result["urls"] != 2 || result["users"] != 1 {
+		t.Errorf("invalid behavior: %v", result)
+	}
+	u := &testURL{}
+	if err := restored.FindURL(ctx, 40, true, u); err != nil || u.Original != "http://b" || u.TTL == nil {
+		t.Errorf("invalid behavior: %v, %v", u, err)
+	}
+	user := &testUser{}
+	if err := restored.FindUser(ctx, "abc", user); err != nil || user.Name != "user" {
+		t.Errorf("invalid behavior: %v, %v", user, err)
+	}
+	// new identifiers don't collide with restored ones
+	if n, err := restored.ReserveURLs(ctx, 1); err != nil || n != 41 {
+		t.Errorf("invalid behavior: %v, %v", n, err)
+	}
+	// repeated restore replaces existing tracks
+	for i := 0; i < 2; i++ {
+		if _, err := Restore(ctx, restored, bytes.NewReader(tracksBuf.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, expected := range map[string]int{"tracks": 1, "rollups": 1} {
+		n := 0
+		err := restored.DumpDocs(ctx, name, func(doc []byte) error {
+			n++
+			return nil
+		})
+		if err != nil || n != expected {
+			t.Errorf("invalid behavior [%v]: %v, %v", name, n, err)
+		}
+	}
+	// running node's block can't be changed
+	if _, err := restored.LeaseURLs(ctx, "node1", 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.AcquireLock(ctx, "ids:node1", "node1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Restore(ctx, restored, bytes.NewReader(buf.Bytes())); err == nil {
+		t.Error("invalid behavior")
+	}
+	if err := restored.ReleaseLock(ctx, "ids:node1", "node1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Restore(ctx, restored, bytes.NewReader(buf.Bytes())); err != nil {
+		t.Errorf("invalid behavior: %v", err)
+	}
+	// restore releases nodes' locks
+	if err := restored.AcquireLock(ctx, "ids:node1", "node1", time.Minute); err != nil {
+		t.Errorf("invalid behavior: %v", err)
+	}
+	if _, err := Restore(ctx, restored, bytes.NewReader([]byte("bad"))); err == nil {
+		t.Error("invalid behavior")
+	}
+}
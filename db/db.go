@@ -2,33 +2,54 @@
 // Use of this source code is governed by a GPL-style
 // license that can be found in the LICENSE file.
 
-// Package db implements MongoDB database access methods.
+// Package db implements data storage access methods.
 package db
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
-	"net"
 	"os"
 	"time"
 
 	"github.com/z0rr0/luss/conf"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 const (
-	maxLockAttempts     = 10
-	lockKey             = 1
-	sessionKey      key = 0
+	storageKey key = 0
+	// urlCounter is a counter name of short URLs identifiers.
+	urlCounter = "urls"
+	// RandomMin is a minimal identifier of random short URLs (62^6, "1000000" in basis 62),
+	// sequential identifiers are less than it.
+	RandomMin int64 = 56800235584
+	// OffUser, OffClicks, OffExpired, OffSpam and OffHealth are reasons of short URLs
+	// deactivation, only administrators can activate links disabled by the system.
+	OffUser    = "user"
+	OffClicks  = "clicks"
+	OffExpired = "expired"
+	OffSpam    = "spam"
+	OffHealth  = "health"
 )
 
 var (
+	// ErrNotFound is error when a requested document is not found.
+	ErrNotFound = errors.New("not found")
+	// ErrDuplicate is error when a document with the same identifier already exists.
+	ErrDuplicate = errors.New("duplicate item")
+	// ErrLocked is error when a lock is held by other owner.
+	ErrLocked = errors.New("locked by other owner")
+	// Instance is unique identifier of the running process.
+	Instance = newInstance()
 	// Logger is a logger for error messages
 	Logger = log.New(os.Stderr, "LOGGER [db]: ", log.Ldate|log.Ltime|log.Lshortfile)
 	// Colls is a map of db collections names.
@@ -39,103 +60,349 @@ var (
 		"locks":  "locks",
 		"users":  "users",
 		"tests":  "tests",
+		// counters is a collection of sequences
+		"counters": "counters",
+		// leases is a collection of nodes' identifiers blocks
+		"leases": "leases",
+		// migrations is a collection of applied schema migrations
+		"migrations": "migrations",
+		// rollups is a collection of tracks daily aggregates
+		"rollups": "rollups",
+		// archive is a collection of raw tracks after rollup
+		"archive": "tracks_archive",
 	}
 )
 
-// key is internal type to get session value from context.
+// key is internal type to get storage value from context.
 type key int
 
 // Item is any DB item, it contains only identifier.
 type Item struct {
-	ID bson.ObjectId `bson:"_id"`
+	ID primitive.ObjectID `bson:"_id"`
 }
 
 // ItemURL is any DB item, it contains only short URL identifier.
 type ItemURL struct {
-	ID int64 `bson:"_id"`
+	ID   int64 `bson:"_id"`
+	Left int64 `bson:"left,omitempty"`
 }
 
-// NewContext returns a new Context carrying MongoDB session.
-func NewContext(ctx context.Context, s *mgo.Session) context.Context {
-	return context.WithValue(ctx, sessionKey, s)
+// Counter is a named sequence.
+type Counter struct {
+	ID  string `bson:"_id"`
+	Seq int64  `bson:"seq"`
 }
 
-// CtxSession finds and returns MongoDB session from the Context.
-func CtxSession(ctx context.Context) (*mgo.Session, error) {
-	s, ok := ctx.Value(sessionKey).(*mgo.Session)
-	if !ok {
-		return nil, errors.New("not found context db session")
+// Lease is a block of short URLs identifiers [Lo, Hi] reserved by a node.
+type Lease struct {
+	Node    string    `bson:"_id"`
+	Lo      int64     `bson:"lo"`
+	Hi      int64     `bson:"hi"`
+	Created time.Time `bson:"ts"`
+}
+
+// Lock is a distributed lock, it is valid until expiration time.
+type Lock struct {
+	Key    string    `bson:"_id"`
+	Owner  string    `bson:"owner"`
+	Expire time.Time `bson:"exp"`
+}
+
+// Rollup is a daily aggregate of tracks by short URL, country and city.
+type Rollup struct {
+	ID      string    `bson:"_id"`
+	Day     time.Time `bson:"day"`
+	Short   string    `bson:"short"`
+	Group   string    `bson:"group"`
+	Tag     string    `bson:"tag"`
+	Country string    `bson:"country"`
+	City    string    `bson:"city"`
+	Count   int64     `bson:"n"`
+}
+
+// trackItem contains track's fields that are used in rollups.
+type trackItem struct {
+	ID    interface{} `bson:"_id"`
+	Short string      `bson:"short"`
+	Group string      `bson:"group"`
+	Tag   string      `bson:"tag"`
+	Geo   struct {
+		Country string `bson:"country"`
+		City    string `bson:"city"`
+	} `bson:"geo"`
+	Created time.Time `bson:"ts"`
+}
+
+// rollups is a set of daily aggregates by their identifiers.
+type rollups map[string]*Rollup
+
+// add counts the track in its daily aggregate.
+func (r rollups) add(t *trackItem) {
+	day := t.Created.UTC().Truncate(24 * time.Hour)
+	id := fmt.Sprintf("%v:%v:%v:%v", day.Format("2006-01-02"), t.Short, t.Geo.Country, t.Geo.City)
+	if item, ok := r[id]; ok {
+		item.Count++
+		return
+	}
+	r[id] = &Rollup{
+		ID:      id,
+		Day:     day,
+		Short:   t.Short,
+		Group:   t.Group,
+		Tag:     t.Tag,
+		Country: t.Geo.Country,
+		City:    t.Geo.City,
+		Count:   1,
 	}
-	return s, nil
 }
 
-// NewSession returns new MongoDB session based on Conn data.
-func NewSession(c *conf.Conn, primary bool) (*mgo.Session, error) {
-	c.M.Lock()
-	defer c.M.Unlock()
-	switch {
-	case (c.S == nil) || (c.S.Ping() != nil):
-		s, err := mongoDBConnection(c.Cfg)
-		if err != nil {
-			return nil, err
-		}
-		if !primary {
-			s.SetMode(mgo.SecondaryPreferred, true)
-		}
-		Logger.Printf("new session creation: %p", s)
-		c.S = s
-	case c.S.Ping() != nil:
-		s, err := mongoDBConnection(c.Cfg)
-		if err != nil {
-			return nil, err
-		}
-		if !primary {
-			s.SetMode(mgo.SecondaryPreferred, true)
-		}
-		Logger.Printf("new session recreation: %p", s)
-		// old session is not valid
-		// close it and use new one
-		old := c.S
-		c.S = s
-		old.Close()
-		old = nil
+// Filter is a set of conditions to select short URLs.
+type Filter struct {
+	Group  string
+	Tag    string
+	Period [2]*time.Time
+	Active bool
+}
+
+// Iter is an iterator over found documents.
+type Iter interface {
+	// Next decodes the next document into result,
+	// it returns false if there are no more documents or an error occurred.
+	Next(result interface{}) bool
+	// Close closes the iterator and returns an error if it occurred.
+	Close() error
+}
+
+// URLStorage contains methods to handle short URLs.
+// Documents are pointers to structures with bson tags.
+type URLStorage interface {
+	// InsertURLs saves new short URLs, all of them or nothing,
+	// ErrDuplicate is returned for existing identifiers or aliases.
+	InsertURLs(ctx context.Context, docs ...interface{}) error
+	// FindURL finds a short URL by its identifier,
+	// only active item is returned if active is true.
+	FindURL(ctx context.Context, id int64, active bool, result interface{}) error
+	// FindAlias finds a short URL by its unique alias,
+	// only active item is returned if active is true.
+	FindAlias(ctx context.Context, alias string, active bool, result interface{}) error
+	// MaxURL returns max sequential short URL identifier, zero is returned for empty storage.
+	MaxURL(ctx context.Context) (int64, error)
+	// ReserveURLs atomically reserves n sequential identifiers for new short URLs
+	// and returns the last one. The sequence starts from MaxURL value.
+	ReserveURLs(ctx context.Context, n int) (int64, error)
+	// SyncURLs moves the sequence of short URLs identifiers to id if it is less.
+	SyncURLs(ctx context.Context, id int64) error
+	// LeaseURLs reserves a block of n identifiers and saves it as node's lease,
+	// a previous lease of the node is replaced.
+	LeaseURLs(ctx context.Context, node string, n int) (*Lease, error)
+	// FindLease returns a current lease of the node.
+	FindLease(ctx context.Context, node string) (*Lease, error)
+	// IsLeased checks that the identifier is inside of some node's current lease.
+	IsLeased(ctx context.Context, id int64) (bool, error)
+	// MaxURLIn returns max short URL identifier from the range [lo, hi],
+	// it returns lo-1 if there are no short URLs there.
+	MaxURLIn(ctx context.Context, lo, hi int64) (int64, error)
+	// CountURLs returns a number of filtered short URLs.
+	CountURLs(ctx context.Context, f *Filter) (int, error)
+	// FilterURLs returns an iterator of filtered short URLs,
+	// they are sorted by identifiers in descending order.
+	FilterURLs(ctx context.Context, f *Filter, skip, limit int) Iter
+	// ScanURLs returns an iterator of active short URLs with identifiers
+	// greater than after in ascending order, max number of items is limit.
+	ScanURLs(ctx context.Context, after int64, limit int) Iter
+	// CountSpam returns numbers of all user's short URLs
+	// and ones which spam score is greater than min.
+	CountSpam(ctx context.Context, user string, min float64) (int, int, error)
+	// DuplicateURLs returns an iterator of active short URLs with the same
+	// normalized original URL, author and group.
+	DuplicateURLs(ctx context.Context, norm, user, group string) Iter
+	// ExpiredURLs returns an iterator of active short URLs with TTL before t.
+	ExpiredURLs(ctx context.Context, t time.Time) Iter
+	// UpdateURL sets new values of short URL's fields.
+	UpdateURL(ctx context.Context, id int64, set map[string]interface{}) error
+	// ClickURL atomically decreases a number of left redirects of active short URL
+	// and returns new value, short URL is deactivated when this value becomes zero.
+	// ErrNotFound is returned if short URL is not active or has no left redirects.
+	ClickURL(ctx context.Context, id int64) (int64, error)
+	// DisableURL deactivates a short URL with the reason.
+	DisableURL(ctx context.Context, id int64, reason string) error
+	// DisableExpired deactivates all short URLs with TTL before t
+	// and returns a number of changed items.
+	DisableExpired(ctx context.Context, t time.Time) (int, error)
+	// RemoveURLs deletes short URLs that were moved to trash before t.
+	RemoveURLs(ctx context.Context, t time.Time) (int, error)
+}
+
+// UserStorage contains methods to handle users.
+type UserStorage interface {
+	// InsertUser saves new user, ErrDuplicate is returned for existing one.
+	InsertUser(ctx context.Context, doc interface{}) error
+	// FindUser finds an active user by token.
+	FindUser(ctx context.Context, token string, result interface{}) error
+	// UpdateToken changes user's token.
+	UpdateToken(ctx context.Context, name, token string, t time.Time) error
+	// DisableUser deactivates user's account.
+	DisableUser(ctx context.Context, name string, t time.Time) error
+}
+
+// TrackStorage contains methods to save requests tracks.
+type TrackStorage interface {
+	// InsertTrack saves info about a request.
+	InsertTrack(ctx context.Context, doc interface{}) error
+	// RollupTracks adds tracks created before t to daily aggregates
+	// and removes them or moves to the archive. It returns a number of handled tracks.
+	RollupTracks(ctx context.Context, t time.Time, archive bool) (int, error)
+}
+
+// LockStorage contains methods of distributed locks.
+type LockStorage interface {
+	// AcquireLock takes the lock for the owner during ttl,
+	// an expired lock of other owner is taken over.
+	// ErrLocked is returned if the lock is held by other owner.
+	AcquireLock(ctx context.Context, key, owner string, ttl time.Duration) error
+	// RenewLock prolongs owner's lock for ttl,
+	// ErrLocked is returned if the lock was lost.
+	RenewLock(ctx context.Context, key, owner string, ttl time.Duration) error
+	// ReleaseLock releases owner's lock.
+	ReleaseLock(ctx context.Context, key, owner string) error
+}
+
+// TestStorage contains methods for test requests.
+type TestStorage interface {
+	// AddTest saves new test item.
+	AddTest(ctx context.Context, t time.Time) error
+	// RemoveTest removes one test item.
+	RemoveTest(ctx context.Context) error
+	// CountTests returns a number of test items.
+	CountTests(ctx context.Context) (int, error)
+}
+
+// SchemaStorage contains methods to control storage schema version.
+type SchemaStorage interface {
+	// SchemaVersion returns a version of last applied migration, zero for new storage.
+	SchemaVersion(ctx context.Context) (int, error)
+	// SaveMigration marks the migration as applied.
+	SaveMigration(ctx context.Context, m *Migration) error
+}
+
+// BackupStorage contains methods to copy raw documents of collections.
+type BackupStorage interface {
+	// DumpDocs calls fn for every BSON document of the collection.
+	DumpDocs(ctx context.Context, name string, fn func(doc []byte) error) error
+	// RestoreDocs saves BSON documents to the collection, existing ones are replaced.
+	RestoreDocs(ctx context.Context, name string, docs [][]byte) error
+}
+
+// Storage is a common data storage.
+// Its methods are aborted when the context is done.
+type Storage interface {
+	URLStorage
+	UserStorage
+	TrackStorage
+	LockStorage
+	TestStorage
+	SchemaStorage
+	BackupStorage
+	// Close releases storage resources.
+	Close()
+}
+
+// newInstance returns random identifier of the process.
+func newInstance() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		Logger.Printf("random instance identifier error: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// LockOwner returns locks owner name of the running process on the node.
+func LockOwner(node string) string {
+	return fmt.Sprintf("%v:%v:%v", node, os.Getpid(), Instance)
+}
+
+// NewContext returns a new Context carrying a data storage.
+func NewContext(ctx context.Context, st Storage) context.Context {
+	return context.WithValue(ctx, storageKey, st)
+}
+
+// CtxStorage finds and returns a data storage from the Context.
+func CtxStorage(ctx context.Context) (Storage, error) {
+	st, ok := ctx.Value(storageKey).(Storage)
+	if !ok {
+		return nil, errors.New("not found context db storage")
 	}
-	return c.S.Clone(), nil
+	return st, nil
 }
 
-// NewCtxSession creates new database session and saves it to the context.
-func NewCtxSession(ctx context.Context, c *conf.Config, primary bool) (context.Context, *mgo.Session, error) {
+// NewStorage returns new data storage based on the configuration.
+// It should be closed after the usage.
+func NewStorage(c *conf.Config, primary bool) (Storage, error) {
 	if c.Conn == nil {
-		return ctx, nil, errors.New("empty main session")
+		return nil, errors.New("empty main session")
 	}
-	s, err := NewSession(c.Conn, primary)
+	if c.Storage.Engine == conf.BoltEngine {
+		return NewBolt(c.Conn)
+	}
+	return NewMongo(c.Conn, primary)
+}
+
+// NewCtxStorage creates new data storage and saves it to the context.
+func NewCtxStorage(ctx context.Context, c *conf.Config, primary bool) (context.Context, Storage, error) {
+	st, err := NewStorage(c, primary)
 	if err != nil {
 		return ctx, nil, err
 	}
-	ctx = NewContext(ctx, s)
-	return ctx, s, nil
+	ctx = NewContext(ctx, st)
+	return ctx, st, nil
 }
 
-// C return a collection pointer by its name from default database.
-func C(ctx context.Context, name string) (*mgo.Collection, error) {
-	s, err := CtxSession(ctx)
-	if err != nil {
-		return nil, err
+// NewClient returns MongoDB client based on Conn data.
+// The client keeps a pool of connections, so it is created only once
+// and it is shared between storages.
+func NewClient(c *conf.Conn) (*mongo.Client, error) {
+	c.M.Lock()
+	defer c.M.Unlock()
+	if c.C == nil {
+		client, err := mongoDBConnection(c.Cfg)
+		if err != nil {
+			return nil, err
+		}
+		Logger.Printf("new client creation: %p", client)
+		c.C = client
 	}
-	return Coll(s, name)
+	return c.C, nil
 }
 
 // Coll return database collection pointer.
-func Coll(s *mgo.Session, name string) (*mgo.Collection, error) {
+func Coll(d *mongo.Database, name string) (*mongo.Collection, error) {
 	cname, ok := Colls[name]
 	if !ok {
 		return nil, errors.New("unknown collection name")
 	}
-	return s.DB("").C(cname), nil
+	return d.Collection(cname), nil
 }
 
-// MongoCredential initializes MongoDB credentials.
+// MongoCredential initializes MongoDB client options.
 func MongoCredential(cfg *conf.MongoCfg) error {
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	opts := options.Client().
+		SetHosts(cfg.Addrs()).
+		SetConnectTimeout(timeout).
+		SetServerSelectionTimeout(timeout)
+	if cfg.Username != "" {
+		opts.SetAuth(options.Credential{
+			AuthSource: cfg.AuthDB,
+			Username:   cfg.Username,
+			Password:   cfg.Password,
+		})
+	}
+	if cfg.ReplicaSet != "" {
+		opts.SetReplicaSet(cfg.ReplicaSet)
+	}
+	if cfg.PoolLimit > 1 {
+		opts.SetMaxPoolSize(uint64(cfg.PoolLimit))
+	}
 	if cfg.Ssl {
 		pool := x509.NewCertPool()
 		pemData, err := ioutil.ReadFile(cfg.SslKeyFile)
@@ -150,100 +417,52 @@ func MongoCredential(cfg *conf.MongoCfg) error {
 		if err != nil {
 			return err
 		}
-		tlsConfig := &tls.Config{
+		opts.SetTLSConfig(&tls.Config{
 			RootCAs:      pool,
 			Certificates: []tls.Certificate{cert},
-		}
-		dial := func(addr *mgo.ServerAddr) (net.Conn, error) {
-			conn, err := tls.Dial("tcp", addr.String(), tlsConfig)
-			if err != nil {
-				cfg.Logger.Printf("tls.Dial(%s) failed with %v", addr, err)
-				return nil, err
-			}
-			cfg.Logger.Printf("SSL connection: %v", addr.String())
-			return conn, nil
-		}
-		cfg.MongoCred = &mgo.DialInfo{
-			Addrs:          cfg.Addrs(),
-			Timeout:        time.Duration(cfg.Timeout) * time.Second,
-			Database:       cfg.Database,
-			Source:         cfg.AuthDB,
-			Username:       cfg.Username,
-			Password:       cfg.Password,
-			ReplicaSetName: cfg.ReplicaSet,
-			DialServer:     dial,
-		}
-	} else {
-		cfg.MongoCred = &mgo.DialInfo{
-			Addrs:          cfg.Addrs(),
-			Timeout:        time.Duration(cfg.Timeout) * time.Second,
-			Database:       cfg.Database,
-			Source:         cfg.AuthDB,
-			Username:       cfg.Username,
-			Password:       cfg.Password,
-			ReplicaSetName: cfg.ReplicaSet,
-		}
+		})
+	}
+	if cfg.Debug {
+		opts.SetMonitor(&event.CommandMonitor{
+			Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+				cfg.Logger.Printf("%v [%v]: %v", e.CommandName, e.ConnectionID, e.Command)
+			},
+			Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+				cfg.Logger.Printf("%v [%v] failed: %v", e.CommandName, e.ConnectionID, e.Failure)
+			},
+		})
 	}
+	cfg.MongoCred = opts
 	return nil
 }
 
 // mongoDBConnection is an initialization of MongoDb connection.
-func mongoDBConnection(cfg *conf.MongoCfg) (*mgo.Session, error) {
+func mongoDBConnection(cfg *conf.MongoCfg) (*mongo.Client, error) {
 	if cfg.MongoCred == nil {
 		err := MongoCredential(cfg)
 		if err != nil {
 			return nil, err
 		}
 	}
-	session, err := mgo.DialWithInfo(cfg.MongoCred)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Timeout)*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, cfg.MongoCred)
 	if err != nil {
 		return nil, err
 	}
-	if cfg.PoolLimit > 1 {
-		session.SetPoolLimit(cfg.PoolLimit)
-	}
-	// session.EnsureSafe(&mgo.Safe{W: 1})
-	if cfg.Debug {
-		mgo.SetLogger(cfg.Logger)
-		mgo.SetDebug(true)
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
 	}
-	return session, nil
+	return client, nil
 }
 
 // CheckID converts string s to ObjectId if it is possible,
 // otherwise it returns error.
-func CheckID(s string) (bson.ObjectId, error) {
-	d, err := hex.DecodeString(s)
-	if err != nil || len(d) != 12 {
-		return "", errors.New("invalid database ID")
-	}
-	return bson.ObjectId(d), nil
-}
-
-// LockURL locks short URL creation actions.
-// It is useful for distributed usage,
-// database is used for consistency short URLs values.
-func LockURL(s *mgo.Session) error {
-	delay := time.Duration(time.Millisecond)
-	coll := s.DB("").C(Colls["locks"])
-	for i := 0; i < maxLockAttempts; i++ {
-		err := coll.Insert(bson.M{"_id": lockKey})
-		if err == nil {
-			return nil
-		}
-		time.Sleep(delay)
-		delay *= 2
-	}
-	return errors.New("can not lock URLs")
-}
-
-// UnlockURL unlocks short URLs creation actions.
-func UnlockURL(s *mgo.Session) error {
-	coll := s.DB("").C(Colls["locks"])
-	err := coll.RemoveId(lockKey)
+func CheckID(s string) (primitive.ObjectID, error) {
+	id, err := primitive.ObjectIDFromHex(s)
 	if err != nil {
-		Logger.Println(err)
-		return err
+		return id, errors.New("invalid database ID")
 	}
-	return nil
+	return id, nil
 }
@@ -6,13 +6,16 @@
 package db
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/z0rr0/luss/conf"
 	"github.com/z0rr0/luss/test"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
-func TestNewSession(t *testing.T) {
+func TestNewClient(t *testing.T) {
 	cfg, err := conf.Parse(test.TcConfigName())
 	if err != nil {
 		t.Fatalf("invalid behavior")
@@ -21,33 +24,64 @@ func TestNewSession(t *testing.T) {
 	if err != nil {
 		t.Fatalf("invalid behavior")
 	}
-	s, err := NewSession(cfg.Conn, true)
+	defer cfg.Close()
+	client, err := NewClient(cfg.Conn)
 	if err != nil {
 		t.Fatalf("invalid db init")
 	}
-	defer s.Close()
-	ctx := conf.NewContext(cfg)
-	if _, err := CtxSession(ctx); err == nil {
-		t.Fatalf("invalid behavior")
+	if c, err := NewClient(cfg.Conn); err != nil || c != client {
+		t.Errorf("invalid behavior: %p, %p", c, client)
 	}
-	if _, err := C(ctx, "tests"); err == nil {
+	d := client.Database(cfg.Db.Database)
+	if _, err := Coll(d, "test-bad"); err == nil {
 		t.Fatalf("invalid behavior")
 	}
-	ctx = NewContext(ctx, s)
-	if _, err := CtxSession(ctx); err != nil {
+	coll, err := Coll(d, "tests")
+	if err != nil {
 		t.Error(err)
 	}
-	if _, err := C(ctx, "test-bad"); err == nil {
+	_, err = coll.CountDocuments(context.Background(), bson.M{})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewStorage(t *testing.T) {
+	cfg, err := conf.Parse(test.TcConfigName())
+	if err != nil {
 		t.Fatalf("invalid behavior")
 	}
-	coll, err := C(ctx, "tests")
+	err = cfg.Validate()
 	if err != nil {
-		t.Error(err)
+		t.Fatalf("invalid behavior")
 	}
-	_, err = coll.Count()
+	ctx := conf.NewContext(cfg)
+	if _, err := CtxStorage(ctx); err == nil {
+		t.Fatalf("invalid behavior")
+	}
+	ctx, st, err := NewCtxStorage(ctx, cfg, true)
 	if err != nil {
+		t.Fatalf("invalid db init")
+	}
+	defer st.Close()
+	if _, err := CtxStorage(ctx); err != nil {
+		t.Error(err)
+	}
+	if err := st.AddTest(ctx, time.Now()); err != nil {
 		t.Error(err)
 	}
+	if n, err := st.CountTests(ctx); err != nil || n == 0 {
+		t.Errorf("n=%v, err=%v", n, err)
+	}
+	if err := st.RemoveTest(ctx); err != nil {
+		t.Error(err)
+	}
+	// cancelled request aborts the query
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := st.CountTests(cctx); err == nil {
+		t.Error("invalid behavior")
+	}
 }
 
 func TestCheckID(t *testing.T) {
@@ -65,7 +99,7 @@ func TestCheckID(t *testing.T) {
 	}
 }
 
-func BenchmarkSession(b *testing.B) {
+func BenchmarkClient(b *testing.B) {
 	cfg, err := conf.Parse(test.TcConfigName())
 	if err != nil {
 		b.Fatal("invalid behavior")
@@ -74,18 +108,15 @@ func BenchmarkSession(b *testing.B) {
 	if err != nil {
 		b.Fatal("invalid behavior")
 	}
-	s, err := NewSession(cfg.Conn, true)
-	if err != nil {
+	defer cfg.Close()
+	if _, err := NewClient(cfg.Conn); err != nil {
 		b.Fatal(err)
 	}
-	s.Close()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		s, err := NewSession(cfg.Conn, true)
-		if err != nil {
+		if _, err := NewClient(cfg.Conn); err != nil {
 			b.Error(err)
 		}
-		s.Close()
 	}
 }
 
@@ -98,16 +129,14 @@ func BenchmarkContext(b *testing.B) {
 	if err != nil {
 		b.Fatal("invalid behavior")
 	}
-	ctx := conf.NewContext(cfg)
-	s, err := NewSession(cfg.Conn, false)
+	ctx, st, err := NewCtxStorage(conf.NewContext(cfg), cfg, false)
 	if err != nil {
 		b.Fatal(err)
 	}
-	defer s.Close()
-	ctx = NewContext(ctx, s)
+	defer st.Close()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		if _, err := C(ctx, "test"); err != nil {
+		if _, err := CtxStorage(ctx); err != nil {
 			b.Error(err)
 		}
 	}
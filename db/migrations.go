@@ -0,0 +1,208 @@
+// Copyright 2016 Alexander Zaytsev <thebestzorro@yandex.ru>
+// Use of this source code is governed by a GPL-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration is a versioned change of storage schema or data.
+type Migration struct {
+	Version int                                         `bson:"_id"`
+	Name    string                                      `bson:"name"`
+	Applied time.Time                                   `bson:"ts"`
+	Up      func(ctx context.Context, st Storage) error `bson:"-"`
+}
+
+// Migrations is an ordered list of all storage migrations,
+// new items should be added only to the end.
+var Migrations = []*Migration{
+	{Version: 1, Name: "indexes", Up: ensureIndexes(mongoIndexes)},
+	{Version: 2, Name: "urls counter", Up: initURLsCounter},
+	{Version: 3, Name: "rollups indexes", Up: ensureIndexes(rollupIndexes)},
+	{Version: 4, Name: "aliases index", Up: ensureIndexes(aliasIndexes)},
+	{Version: 5, Name: "duplicates index", Up: ensureIndexes(duplicateIndexes)},
+	{Version: 6, Name: "trash index", Up: ensureIndexes(trashIndexes)},
+	{Version: 7, Name: "spam index", Up: ensureIndexes(spamIndexes)},
+	{Version: 8, Name: "rollup batches index", Up: ensureIndexes(batchIndexes)},
+}
+
+// mongoIndexes is a list of MongoDB indexes by collections aliases.
+var mongoIndexes = map[string][]mongo.IndexModel{
+	"urls": {
+		{Keys: bson.D{{Key: "group", Value: 1}, {Key: "off", Value: 1}, {Key: "u", Value: 1}}},
+		{Keys: bson.D{{Key: "off", Value: 1}, {Key: "ttl", Value: 1}}},
+		{Keys: bson.D{{Key: "group", Value: 1}, {Key: "tag", Value: 1}, {Key: "ts", Value: 1}, {Key: "off", Value: 1}}},
+	},
+	"tracks": {
+		{Keys: bson.D{{Key: "group", Value: 1}, {Key: "ts", Value: 1}}},
+	},
+	"users": {
+		{Keys: bson.D{{Key: "token", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"leases": {
+		{Keys: bson.D{{Key: "lo", Value: 1}, {Key: "hi", Value: 1}}},
+	},
+}
+
+// rollupIndexes is a list of MongoDB indexes for tracks rollup.
+var rollupIndexes = map[string][]mongo.IndexModel{
+	"tracks": {
+		{Keys: bson.D{{Key: "ts", Value: 1}}},
+	},
+	"rollups": {
+		{Keys: bson.D{{Key: "short", Value: 1}, {Key: "day", Value: 1}}},
+		{Keys: bson.D{{Key: "group", Value: 1}, {Key: "day", Value: 1}}},
+	},
+}
+
+// aliasIndexes is a list of MongoDB indexes for short URLs aliases,
+// most of short URLs don't have an alias, so the index is sparse.
+var aliasIndexes = map[string][]mongo.IndexModel{
+	"urls": {
+		{Keys: bson.D{{Key: "alias", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+	},
+}
+
+// duplicateIndexes is a list of MongoDB indexes to find short URLs
+// with the same normalized original URL.
+var duplicateIndexes = map[string][]mongo.IndexModel{
+	"urls": {
+		{Keys: bson.D{{Key: "norm", Value: 1}, {Key: "u", Value: 1}, {Key: "group", Value: 1}, {Key: "off", Value: 1}}},
+	},
+}
+
+// trashIndexes is a list of MongoDB indexes to find deleted short URLs,
+// only a few of them are in trash, so the index is sparse.
+var trashIndexes = map[string][]mongo.IndexModel{
+	"urls": {
+		{Keys: bson.D{{Key: "del", Value: 1}}, Options: options.Index().SetSparse(true)},
+	},
+}
+
+// spamIndexes is a list of MongoDB indexes to calculate users' reputation.
+var spamIndexes = map[string][]mongo.IndexModel{
+	"urls": {
+		{Keys: bson.D{{Key: "u", Value: 1}, {Key: "spam", Value: 1}}},
+	},
+}
+
+// batchIndexes is a list of MongoDB indexes to find tracks of rollup batches,
+// only tracks of the current batch are marked, so the index is sparse.
+var batchIndexes = map[string][]mongo.IndexModel{
+	"tracks": {
+		{Keys: bson.D{{Key: "roll", Value: 1}}, Options: options.Index().SetSparse(true)},
+	},
+}
+
+// ensureIndexes returns a migration that creates MongoDB indexes,
+// Bolt storage doesn't need them.
+func ensureIndexes(models map[string][]mongo.IndexModel) func(ctx context.Context, st Storage) error {
+	return func(ctx context.Context, st Storage) error {
+		m, ok := st.(*Mongo)
+		if !ok {
+			return nil
+		}
+		for name, indexes := range models {
+			if _, err := m.coll(name).Indexes().CreateMany(ctx, indexes); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// initURLsCounter creates short URLs counter for existing short URLs.
+func initURLsCounter(ctx context.Context, st Storage) error {
+	return st.SyncURLs(ctx, 0)
+}
+
+// Pending returns migrations that were not applied yet.
+func Pending(ctx context.Context, st Storage) ([]*Migration, error) {
+	version, err := st.SchemaVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := []*Migration{}
+	for _, m := range Migrations {
+		if m.Version > version {
+			result = append(result, m)
+		}
+	}
+	return result, nil
+}
+
+// Migrate runs pending migrations in order and returns a number of applied ones.
+// Only one process can do it, so the lock is used, it's renewed in background
+// because one migration can take more time than the lock ttl.
+func Migrate(ctx context.Context, st Storage, owner string, ttl time.Duration) (int, error) {
+	const lockKey = "migrations"
+	if err := st.AcquireLock(ctx, lockKey, owner, ttl); err != nil {
+		return 0, err
+	}
+	defer st.ReleaseLock(ctx, lockKey, owner)
+	migrations, err := Pending(ctx, st)
+	if err != nil {
+		return 0, err
+	}
+	runCtx, stop := keepLock(ctx, st, lockKey, owner, ttl)
+	n, err := apply(runCtx, st, migrations)
+	if errLock := stop(); errLock != nil {
+		return n, fmt.Errorf("migrations lock is lost: %v", errLock)
+	}
+	return n, err
+}
+
+// apply runs migrations and returns a number of applied ones.
+func apply(ctx context.Context, st Storage, migrations []*Migration) (int, error) {
+	for i, m := range migrations {
+		Logger.Printf("migration %v: %v", m.Version, m.Name)
+		if err := m.Up(ctx, st); err != nil {
+			return i, fmt.Errorf("migration %v failed: %v", m.Version, err)
+		}
+		m.Applied = time.Now().UTC()
+		if err := st.SaveMigration(ctx, m); err != nil {
+			return i, err
+		}
+	}
+	return len(migrations), nil
+}
+
+// keepLock renews owner's lock in background until stop is called.
+// Returned context is canceled if the lock is lost, stop returns the renewal error.
+func keepLock(ctx context.Context, st Storage, key, owner string, ttl time.Duration) (context.Context, func() error) {
+	ctx, cancel := context.WithCancel(ctx)
+	done, errc := make(chan struct{}), make(chan error, 1)
+	go func() {
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				errc <- nil
+				return
+			case <-ticker.C:
+				if err := st.RenewLock(ctx, key, owner, ttl); err != nil {
+					errc <- err
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	stop := func() error {
+		close(done)
+		err := <-errc
+		cancel()
+		return err
+	}
+	return ctx, stop
+}
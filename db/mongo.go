@@ -0,0 +1,665 @@
+// Copyright 2016 Alexander Zaytsev <thebestzorro@yandex.ru>
+// Use of this source code is governed by a GPL-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/z0rr0/luss/conf"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// Mongo is MongoDB data storage, it uses a database of shared pooled client.
+type Mongo struct {
+	DB *mongo.Database
+}
+
+// mongoIter is an iterator over MongoDB cursor.
+type mongoIter struct {
+	ctx context.Context
+	cur *mongo.Cursor
+	err error
+}
+
+// Next decodes the next document into result.
+func (it *mongoIter) Next(result interface{}) bool {
+	if it.err != nil || !it.cur.Next(it.ctx) {
+		return false
+	}
+	it.err = it.cur.Decode(result)
+	return it.err == nil
+}
+
+// Close closes the iterator.
+func (it *mongoIter) Close() error {
+	if it.cur == nil {
+		return it.err
+	}
+	if it.err == nil {
+		it.err = it.cur.Err()
+	}
+	if err := it.cur.Close(it.ctx); it.err == nil {
+		it.err = err
+	}
+	return it.err
+}
+
+// NewMongo returns new MongoDB data storage,
+// secondary members are preferred for reading if primary is false.
+func NewMongo(c *conf.Conn, primary bool) (*Mongo, error) {
+	client, err := NewClient(c)
+	if err != nil {
+		return nil, err
+	}
+	opts := options.Database()
+	if !primary {
+		opts.SetReadPreference(readpref.SecondaryPreferred())
+	}
+	return &Mongo{DB: client.Database(c.Cfg.Database, opts)}, nil
+}
+
+// mongoErr converts MongoDB errors to common storage ones.
+func mongoErr(err error) error {
+	switch {
+	case err == mongo.ErrNoDocuments:
+		return ErrNotFound
+	case mongo.IsDuplicateKeyError(err):
+		return ErrDuplicate
+	}
+	return err
+}
+
+// coll returns a collection by its alias name.
+// Aliases are predefined, so it panics for unknown name.
+func (m *Mongo) coll(name string) *mongo.Collection {
+	coll, err := Coll(m.DB, name)
+	if err != nil {
+		panic(err)
+	}
+	return coll
+}
+
+// updateOne updates one document, ErrNotFound is returned if nothing is matched.
+func (m *Mongo) updateOne(ctx context.Context, name string, filter, update interface{}) error {
+	result, err := m.coll(name).UpdateOne(ctx, filter, update)
+	if err != nil {
+		return mongoErr(err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Close does nothing, because the client is shared.
+func (m *Mongo) Close() {
+}
+
+// InsertURLs saves new short URLs, ordered insert stops on the first error,
+// so documents inserted before it are deleted.
+func (m *Mongo) InsertURLs(ctx context.Context, docs ...interface{}) error {
+	coll := m.coll("urls")
+	_, err := coll.InsertMany(ctx, docs)
+	if err == nil {
+		return nil
+	}
+	e, ok := err.(mongo.BulkWriteException)
+	if ok && len(e.WriteErrors) > 0 && e.WriteErrors[0].Index > 0 {
+		ids := make(bson.A, e.WriteErrors[0].Index)
+		for i, doc := range docs[:len(ids)] {
+			raw, errRaw := bson.Marshal(doc)
+			if errRaw != nil {
+				return errRaw
+			}
+			ids[i] = bson.Raw(raw).Lookup("_id")
+		}
+		if _, errDel := coll.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}}); errDel != nil {
+			return errDel
+		}
+	}
+	return mongoErr(err)
+}
+
+// FindURL finds a short URL by its identifier.
+func (m *Mongo) FindURL(ctx context.Context, id int64, active bool, result interface{}) error {
+	condition := bson.M{"_id": id}
+	if active {
+		condition["off"] = false
+	}
+	return mongoErr(m.coll("urls").FindOne(ctx, condition).Decode(result))
+}
+
+// FindAlias finds a short URL by its alias.
+func (m *Mongo) FindAlias(ctx context.Context, alias string, active bool, result interface{}) error {
+	condition := bson.M{"alias": alias}
+	if active {
+		condition["off"] = false
+	}
+	return mongoErr(m.coll("urls").FindOne(ctx, condition).Decode(result))
+}
+
+// maxURL returns a short URL with max identifier satisfied to the condition.
+func (m *Mongo) maxURL(ctx context.Context, condition bson.M) (*ItemURL, error) {
+	maxURL := &ItemURL{}
+	opts := options.FindOne().SetSort(bson.M{"_id": -1})
+	err := m.coll("urls").FindOne(ctx, condition, opts).Decode(maxURL)
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+	return maxURL, nil
+}
+
+// MaxURL returns max sequential short URL identifier.
+func (m *Mongo) MaxURL(ctx context.Context) (int64, error) {
+	maxURL, err := m.maxURL(ctx, bson.M{"_id": bson.M{"$lt": RandomMin}})
+	if err != nil {
+		if err == ErrNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return maxURL.ID, nil
+}
+
+// filterCondition returns a condition to find short URLs by the filter.
+func filterCondition(f *Filter) bson.M {
+	conditions := bson.M{"group": f.Group, "tag": f.Tag}
+	if f.Active {
+		conditions["off"] = false
+	}
+	switch {
+	case f.Period[0] != nil && f.Period[1] != nil:
+		conditions["$and"] = []bson.M{
+			{"ts": bson.M{"$gte": *f.Period[0]}},
+			{"ts": bson.M{"$lte": *f.Period[1]}},
+		}
+	case f.Period[0] != nil:
+		conditions["ts"] = bson.M{"$gte": *f.Period[0]}
+	case f.Period[1] != nil:
+		conditions["ts"] = bson.M{"$lte": *f.Period[1]}
+	}
+	return conditions
+}
+
+// CountURLs returns a number of filtered short URLs.
+func (m *Mongo) CountURLs(ctx context.Context, f *Filter) (int, error) {
+	n, err := m.coll("urls").CountDocuments(ctx, filterCondition(f))
+	return int(n), err
+}
+
+// initCounter creates short URLs counter if it doesn't exist yet.
+func (m *Mongo) initCounter(ctx context.Context) error {
+	n, err := m.coll("counters").CountDocuments(ctx, bson.M{"_id": urlCounter})
+	if err != nil || n > 0 {
+		return err
+	}
+	maxID, err := m.MaxURL(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = m.coll("counters").InsertOne(ctx, &Counter{ID: urlCounter, Seq: maxID})
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		// other process could already create it
+		return err
+	}
+	return nil
+}
+
+// ReserveURLs reserves n identifiers for new short URLs by one findAndModify call.
+func (m *Mongo) ReserveURLs(ctx context.Context, n int) (int64, error) {
+	update := bson.M{"$inc": bson.M{"seq": n}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	counter := &Counter{}
+	err := m.coll("counters").FindOneAndUpdate(ctx, bson.M{"_id": urlCounter}, update, opts).Decode(counter)
+	if err == mongo.ErrNoDocuments {
+		if err = m.initCounter(ctx); err != nil {
+			return 0, err
+		}
+		err = m.coll("counters").FindOneAndUpdate(ctx, bson.M{"_id": urlCounter}, update, opts).Decode(counter)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return counter.Seq, nil
+}
+
+// SyncURLs moves short URLs counter forward to id.
+func (m *Mongo) SyncURLs(ctx context.Context, id int64) error {
+	if err := m.initCounter(ctx); err != nil {
+		return err
+	}
+	return m.updateOne(ctx, "counters", bson.M{"_id": urlCounter}, bson.M{"$max": bson.M{"seq": id}})
+}
+
+// LeaseURLs reserves a block of n identifiers for the node.
+func (m *Mongo) LeaseURLs(ctx context.Context, node string, n int) (*Lease, error) {
+	hi, err := m.ReserveURLs(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+	lease := &Lease{Node: node, Lo: hi - int64(n) + 1, Hi: hi, Created: time.Now().UTC()}
+	opts := options.Replace().SetUpsert(true)
+	_, err = m.coll("leases").ReplaceOne(ctx, bson.M{"_id": node}, lease, opts)
+	if err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+// FindLease returns a current lease of the node.
+func (m *Mongo) FindLease(ctx context.Context, node string) (*Lease, error) {
+	lease := &Lease{}
+	err := m.coll("leases").FindOne(ctx, bson.M{"_id": node}).Decode(lease)
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+	return lease, nil
+}
+
+// IsLeased checks that the identifier is inside of some node's lease.
+func (m *Mongo) IsLeased(ctx context.Context, id int64) (bool, error) {
+	condition := bson.M{"lo": bson.M{"$lte": id}, "hi": bson.M{"$gte": id}}
+	n, err := m.coll("leases").CountDocuments(ctx, condition)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// MaxURLIn returns max short URL identifier from the range.
+func (m *Mongo) MaxURLIn(ctx context.Context, lo, hi int64) (int64, error) {
+	maxURL, err := m.maxURL(ctx, bson.M{"_id": bson.M{"$gte": lo, "$lte": hi}})
+	if err != nil {
+		if err == ErrNotFound {
+			return lo - 1, nil
+		}
+		return 0, err
+	}
+	return maxURL.ID, nil
+}
+
+// find returns an iterator of found documents.
+func (m *Mongo) find(ctx context.Context, name string, condition interface{}, opts *options.FindOptions) Iter {
+	cur, err := m.coll(name).Find(ctx, condition, opts)
+	return &mongoIter{ctx: ctx, cur: cur, err: err}
+}
+
+// FilterURLs returns an iterator of filtered short URLs.
+func (m *Mongo) FilterURLs(ctx context.Context, f *Filter, skip, limit int) Iter {
+	opts := options.Find().SetSort(bson.M{"_id": -1}).SetSkip(int64(skip)).SetLimit(int64(limit))
+	return m.find(ctx, "urls", filterCondition(f), opts)
+}
+
+// expiredCondition is a condition to find active expired short URLs.
+func expiredCondition(t time.Time) bson.D {
+	return bson.D{
+		{Key: "off", Value: false},
+		{Key: "ttl", Value: bson.M{"$lt": t}},
+	}
+}
+
+// ScanURLs returns an iterator of active short URLs with identifiers greater than after.
+func (m *Mongo) ScanURLs(ctx context.Context, after int64, limit int) Iter {
+	condition := bson.M{"_id": bson.M{"$gt": after}, "off": false}
+	opts := options.Find().SetSort(bson.M{"_id": 1}).SetLimit(int64(limit))
+	return m.find(ctx, "urls", condition, opts)
+}
+
+// CountSpam returns numbers of all user's short URLs and spam ones.
+func (m *Mongo) CountSpam(ctx context.Context, user string, min float64) (int, int, error) {
+	total, err := m.coll("urls").CountDocuments(ctx, bson.M{"u": user})
+	if err != nil {
+		return 0, 0, err
+	}
+	n, err := m.coll("urls").CountDocuments(ctx, bson.M{"u": user, "spam": bson.M{"$gt": min}})
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(total), int(n), nil
+}
+
+// DuplicateURLs returns an iterator of active short URLs with the same
+// normalized original URL, author and group.
+func (m *Mongo) DuplicateURLs(ctx context.Context, norm, user, group string) Iter {
+	condition := bson.M{"norm": norm, "u": user, "group": group, "off": false}
+	return m.find(ctx, "urls", condition, options.Find().SetSort(bson.M{"_id": 1}))
+}
+
+// ExpiredURLs returns an iterator of active expired short URLs.
+func (m *Mongo) ExpiredURLs(ctx context.Context, t time.Time) Iter {
+	return m.find(ctx, "urls", expiredCondition(t), options.Find())
+}
+
+// UpdateURL sets new values of short URL's fields.
+func (m *Mongo) UpdateURL(ctx context.Context, id int64, set map[string]interface{}) error {
+	return m.updateOne(ctx, "urls", bson.M{"_id": id}, bson.M{"$set": bson.M(set)})
+}
+
+// ClickURL atomically decreases a number of left redirects of active short URL.
+func (m *Mongo) ClickURL(ctx context.Context, id int64) (int64, error) {
+	condition := bson.M{"_id": id, "off": false, "left": bson.M{"$gt": 0}}
+	update := bson.M{"$inc": bson.M{"left": -1}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"left": 1})
+	item := &ItemURL{}
+	err := m.coll("urls").FindOneAndUpdate(ctx, condition, update, opts).Decode(item)
+	if err != nil {
+		return 0, mongoErr(err)
+	}
+	if item.Left == 0 {
+		// other requests can't pass the condition, so it's safe to do it separately
+		if err := m.DisableURL(ctx, id, OffClicks); err != nil {
+			return 0, err
+		}
+	}
+	return item.Left, nil
+}
+
+// DisableURL deactivates a short URL with the reason.
+func (m *Mongo) DisableURL(ctx context.Context, id int64, reason string) error {
+	return m.updateOne(ctx, "urls", bson.M{"_id": id}, bson.M{"$set": bson.M{"off": true, "why": reason}})
+}
+
+// DisableExpired deactivates all expired short URLs.
+func (m *Mongo) DisableExpired(ctx context.Context, t time.Time) (int, error) {
+	update := bson.M{"$set": bson.M{"off": true, "why": OffExpired}}
+	result, err := m.coll("urls").UpdateMany(ctx, expiredCondition(t), update)
+	if err != nil {
+		return 0, err
+	}
+	return int(result.ModifiedCount), nil
+}
+
+// RemoveURLs deletes short URLs that were moved to trash before t.
+func (m *Mongo) RemoveURLs(ctx context.Context, t time.Time) (int, error) {
+	result, err := m.coll("urls").DeleteMany(ctx, bson.M{"del": bson.M{"$lt": t}})
+	if err != nil {
+		return 0, err
+	}
+	return int(result.DeletedCount), nil
+}
+
+// InsertUser saves new user.
+func (m *Mongo) InsertUser(ctx context.Context, doc interface{}) error {
+	_, err := m.coll("users").InsertOne(ctx, doc)
+	return mongoErr(err)
+}
+
+// FindUser finds an active user by token.
+func (m *Mongo) FindUser(ctx context.Context, token string, result interface{}) error {
+	return mongoErr(m.coll("users").FindOne(ctx, bson.M{"token": token, "off": false}).Decode(result))
+}
+
+// UpdateToken changes user's token.
+func (m *Mongo) UpdateToken(ctx context.Context, name, token string, t time.Time) error {
+	return m.updateOne(ctx, "users", bson.M{"_id": name}, bson.M{"$set": bson.M{"token": token, "mt": t}})
+}
+
+// DisableUser deactivates user's account.
+func (m *Mongo) DisableUser(ctx context.Context, name string, t time.Time) error {
+	update := bson.M{"$set": bson.M{"off": true, "mt": t}}
+	return m.updateOne(ctx, "users", bson.M{"_id": name, "off": false}, update)
+}
+
+// InsertTrack saves info about a request.
+func (m *Mongo) InsertTrack(ctx context.Context, doc interface{}) error {
+	_, err := m.coll("tracks").InsertOne(ctx, doc)
+	return err
+}
+
+// AcquireLock takes the lock for the owner during ttl.
+func (m *Mongo) AcquireLock(ctx context.Context, key, owner string, ttl time.Duration) error {
+	now := time.Now().UTC()
+	selector := bson.M{
+		"_id": key,
+		"$or": []bson.M{{"owner": owner}, {"exp": bson.M{"$lt": now}}},
+	}
+	// the lock of other active owner is not matched by selector,
+	// so upsert fails with duplicate key error
+	opts := options.Replace().SetUpsert(true)
+	_, err := m.coll("locks").ReplaceOne(ctx, selector, &Lock{Key: key, Owner: owner, Expire: now.Add(ttl)}, opts)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrLocked
+	}
+	return err
+}
+
+// RenewLock prolongs owner's lock for ttl.
+func (m *Mongo) RenewLock(ctx context.Context, key, owner string, ttl time.Duration) error {
+	update := bson.M{"$set": bson.M{"exp": time.Now().UTC().Add(ttl)}}
+	err := m.updateOne(ctx, "locks", bson.M{"_id": key, "owner": owner}, update)
+	if err == ErrNotFound {
+		return ErrLocked
+	}
+	return err
+}
+
+// ReleaseLock releases owner's lock.
+func (m *Mongo) ReleaseLock(ctx context.Context, key, owner string) error {
+	_, err := m.coll("locks").DeleteOne(ctx, bson.M{"_id": key, "owner": owner})
+	return err
+}
+
+// AddTest saves new test item.
+func (m *Mongo) AddTest(ctx context.Context, t time.Time) error {
+	_, err := m.coll("tests").InsertOne(ctx, bson.M{"ts": t})
+	return err
+}
+
+// RemoveTest removes one test item.
+func (m *Mongo) RemoveTest(ctx context.Context) error {
+	result, err := m.coll("tests").DeleteOne(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// CountTests returns a number of test items.
+func (m *Mongo) CountTests(ctx context.Context) (int, error) {
+	n, err := m.coll("tests").CountDocuments(ctx, bson.M{})
+	return int(n), err
+}
+
+// SchemaVersion returns a version of last applied migration, zero for new storage.
+func (m *Mongo) SchemaVersion(ctx context.Context) (int, error) {
+	last := &Migration{}
+	opts := options.FindOne().SetSort(bson.M{"_id": -1})
+	err := m.coll("migrations").FindOne(ctx, bson.M{}, opts).Decode(last)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return last.Version, nil
+}
+
+// SaveMigration marks the migration as applied.
+func (m *Mongo) SaveMigration(ctx context.Context, mg *Migration) error {
+	_, err := m.coll("migrations").InsertOne(ctx, mg)
+	return mongoErr(err)
+}
+
+// rollupBatch marks old tracks by a new batch identifier and returns it,
+// a batch of previous failed call is returned if it exists.
+// Empty identifier is returned if there are no tracks to roll up.
+func (m *Mongo) rollupBatch(ctx context.Context, t time.Time, limit int64) (string, error) {
+	pending := &struct {
+		Batch string `bson:"roll"`
+	}{}
+	err := m.coll("tracks").FindOne(ctx, bson.M{"roll": bson.M{"$exists": true}}).Decode(pending)
+	switch {
+	case err == nil:
+		return pending.Batch, nil
+	case err != mongo.ErrNoDocuments:
+		return "", err
+	}
+	condition := bson.M{"ts": bson.M{"$lt": t}, "roll": bson.M{"$exists": false}}
+	opts := options.Find().SetSort(bson.M{"_id": 1}).SetLimit(limit).SetProjection(bson.M{"_id": 1})
+	cur, err := m.coll("tracks").Find(ctx, condition, opts)
+	if err != nil {
+		return "", err
+	}
+	ids := []interface{}{}
+	for cur.Next(ctx) {
+		item := &trackItem{}
+		if err := cur.Decode(item); err != nil {
+			cur.Close(ctx)
+			return "", err
+		}
+		ids = append(ids, item.ID)
+	}
+	if err := cur.Err(); err != nil {
+		cur.Close(ctx)
+		return "", err
+	}
+	cur.Close(ctx)
+	if len(ids) == 0 {
+		return "", nil
+	}
+	batch := primitive.NewObjectID().Hex()
+	update := bson.M{"$set": bson.M{"roll": batch}}
+	if _, err := m.coll("tracks").UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}}, update); err != nil {
+		return "", err
+	}
+	return batch, nil
+}
+
+// rollupApply adds tracks of the batch to daily aggregates and removes them.
+// Aggregates keep the last added batch, so a repeated call doesn't count tracks again.
+func (m *Mongo) rollupApply(ctx context.Context, batch string, archive bool) (int, error) {
+	cur, err := m.coll("tracks").Find(ctx, bson.M{"roll": batch})
+	if err != nil {
+		return 0, err
+	}
+	n, raw, r := 0, []interface{}{}, rollups{}
+	for cur.Next(ctx) {
+		item := &trackItem{}
+		if err := cur.Decode(item); err != nil {
+			cur.Close(ctx)
+			return 0, err
+		}
+		r.add(item)
+		n++
+		if archive {
+			raw = append(raw, append(bson.Raw(nil), cur.Current...))
+		}
+	}
+	if err := cur.Err(); err != nil {
+		cur.Close(ctx)
+		return 0, err
+	}
+	cur.Close(ctx)
+	if n == 0 {
+		return 0, nil
+	}
+	models := make([]mongo.WriteModel, 0, len(r))
+	for _, item := range r {
+		update := bson.M{
+			"$inc": bson.M{"n": item.Count},
+			"$set": bson.M{"batch": batch},
+			"$setOnInsert": bson.M{
+				"day":     item.Day,
+				"short":   item.Short,
+				"group":   item.Group,
+				"tag":     item.Tag,
+				"country": item.Country,
+				"city":    item.City,
+			},
+		}
+		// already added aggregate doesn't match the filter, so its upsert fails by duplicate key
+		filter := bson.M{"_id": item.ID, "batch": bson.M{"$ne": batch}}
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true))
+	}
+	_, err = m.coll("rollups").BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil && !onlyDuplicates(err) {
+		return 0, err
+	}
+	if archive {
+		// tracks could be archived by previous failed call
+		_, err := m.coll("archive").InsertMany(ctx, raw, options.InsertMany().SetOrdered(false))
+		if err != nil && !onlyDuplicates(err) {
+			return 0, err
+		}
+	}
+	if _, err := m.coll("tracks").DeleteMany(ctx, bson.M{"roll": batch}); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// onlyDuplicates returns true if all write errors are duplicate key ones.
+func onlyDuplicates(err error) bool {
+	e, ok := err.(mongo.BulkWriteException)
+	if !ok || e.WriteConcernError != nil || len(e.WriteErrors) == 0 {
+		return false
+	}
+	for _, we := range e.WriteErrors {
+		if we.Code != 11000 {
+			return false
+		}
+	}
+	return true
+}
+
+// RollupTracks adds old tracks to daily aggregates by batches.
+// Tracks of a batch are marked before changes, so the batch of failed call
+// is finished by the next one without double counting.
+func (m *Mongo) RollupTracks(ctx context.Context, t time.Time, archive bool) (int, error) {
+	const batch = 1000
+	var total int
+	for {
+		id, err := m.rollupBatch(ctx, t, batch)
+		if err != nil || id == "" {
+			return total, err
+		}
+		n, err := m.rollupApply(ctx, id, archive)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// DumpDocs calls fn for every BSON document of the collection.
+func (m *Mongo) DumpDocs(ctx context.Context, name string, fn func(doc []byte) error) error {
+	cur, err := m.coll(name).Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		if err := fn(cur.Current); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// RestoreDocs saves BSON documents to the collection, existing ones are replaced.
+func (m *Mongo) RestoreDocs(ctx context.Context, name string, docs [][]byte) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, len(docs))
+	for i, doc := range docs {
+		raw := bson.Raw(doc)
+		id, err := raw.LookupErr("_id")
+		if err != nil {
+			return err
+		}
+		models[i] = mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": id}).SetReplacement(raw).SetUpsert(true)
+	}
+	_, err := m.coll(name).BulkWrite(ctx, models)
+	return err
+}
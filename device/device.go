@@ -0,0 +1,87 @@
+// Copyright 2016 Alexander Zaytsev <thebestzorro@yandex.ru>
+// Use of this source code is governed by a GPL-style
+// license that can be found in the LICENSE file.
+
+// Package device implements User-Agent based routing rules.
+//
+// A platform is detected by User-Agent header, "mobile" rules
+// match all mobile platforms including iOS and Android.
+package device
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// IOS is iPhone, iPad and iPod platform.
+	IOS = "ios"
+	// Android is Android platform.
+	Android = "android"
+	// Mobile is any mobile platform.
+	Mobile = "mobile"
+	// Desktop is a platform of other clients.
+	Desktop = "desktop"
+)
+
+var (
+	// iosMarks are User-Agent parts of iOS devices.
+	iosMarks = []string{"iphone", "ipad", "ipod"}
+	// mobileMarks are User-Agent parts of other mobile devices.
+	mobileMarks = []string{"mobile", "windows phone", "blackberry", "opera mini"}
+)
+
+// Rule is a destination URL for clients of the platform.
+type Rule struct {
+	Platform string `json:"platform" bson:"platform"`
+	URL      string `json:"url" bson:"url"`
+}
+
+// contains returns true if the value contains one of items.
+func contains(value string, items []string) bool {
+	for _, item := range items {
+		if strings.Contains(value, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// Detect returns a platform of User-Agent header value.
+func Detect(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case contains(ua, iosMarks):
+		return IOS
+	case strings.Contains(ua, "android"):
+		return Android
+	case contains(ua, mobileMarks):
+		return Mobile
+	}
+	return Desktop
+}
+
+// Check validates the rules platforms.
+func Check(rules []Rule) error {
+	for _, rule := range rules {
+		switch rule.Platform {
+		case IOS, Android, Mobile, Desktop:
+		default:
+			return fmt.Errorf("unknown platform [%v]", rule.Platform)
+		}
+		if rule.URL == "" {
+			return fmt.Errorf("empty URL of platform [%v]", rule.Platform)
+		}
+	}
+	return nil
+}
+
+// Match returns URL of the first rule that matches the platform.
+func Match(rules []Rule, platform string) (string, bool) {
+	for _, rule := range rules {
+		if rule.Platform == platform || (rule.Platform == Mobile && platform != Desktop) {
+			return rule.URL, true
+		}
+	}
+	return "", false
+}
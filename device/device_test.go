@@ -0,0 +1,48 @@
+// Copyright 2016 Alexander Zaytsev <thebestzorro@yandex.ru>
+// Use of this source code is governed by a GPL-style
+// license that can be found in the LICENSE file.
+
+package device
+
+import (
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	suite := map[string]string{
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 10_0 like Mac OS X) AppleWebKit/602.1.38 Mobile/14A300":       IOS,
+		"Mozilla/5.0 (iPad; CPU OS 9_3_5 like Mac OS X) AppleWebKit/601.1.46 Mobile/13G36":                IOS,
+		"Mozilla/5.0 (Linux; Android 7.0; Nexus 5X Build/NBD90W) AppleWebKit/537.36 Mobile Safari/537.36": Android,
+		"Mozilla/5.0 (compatible; MSIE 10.0; Windows Phone 8.0; Trident/6.0; IEMobile/10.0)":              Mobile,
+		"Mozilla/5.0 (X11; Linux x86_64; rv:49.0) Gecko/20100101 Firefox/49.0":                            Desktop,
+		"curl/7.50.1": Desktop,
+		"":            Desktop,
+	}
+	for ua, expected := range suite {
+		if p := Detect(ua); p != expected {
+			t.Errorf("invalid behavior [%v]: %v", ua, p)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	if err := Check([]Rule{{IOS, "http://a"}, {Mobile, "http://b"}, {Desktop, "http://c"}}); err != nil {
+		t.Error(err)
+	}
+	if err := Check([]Rule{{"windows", "http://a"}}); err == nil {
+		t.Error("invalid behavior")
+	}
+	if err := Check([]Rule{{IOS, ""}}); err == nil {
+		t.Error("invalid behavior")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	rules := []Rule{{IOS, "itms-apps://a"}, {Mobile, "http://m"}}
+	suite := map[string]string{IOS: "itms-apps://a", Android: "http://m", Mobile: "http://m", Desktop: ""}
+	for platform, expected := range suite {
+		if u, ok := Match(rules, platform); u != expected || ok != (expected != "") {
+			t.Errorf("invalid behavior [%v]: %v, %v", platform, u, ok)
+		}
+	}
+}
@@ -24,8 +24,8 @@ import (
 	"github.com/z0rr0/luss/conf"
 	"github.com/z0rr0/luss/core"
 	"github.com/z0rr0/luss/db"
+	"github.com/z0rr0/luss/spam"
 	"github.com/z0rr0/luss/trim"
-	"gopkg.in/mgo.v2"
 )
 
 const (
@@ -33,6 +33,9 @@ const (
 	Name = "LUSS"
 	// Config is default configuration file name
 	Config = "config.json"
+	// oldMaxSpam is min spam score of one weak signal,
+	// smaller "maxspam" values are from the old percents scale.
+	oldMaxSpam = 10
 )
 
 var (
@@ -60,6 +63,73 @@ func interrupt() error {
 	return fmt.Errorf("%v", <-c)
 }
 
+// requestContext returns a context of HTTP request with values of main context,
+// it is cancelled after the timeout or when the client goes away.
+func requestContext(ctx context.Context, r *http.Request, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// backupFile writes backup archive of storage data to the file.
+func backupFile(ctx context.Context, cfg *conf.Config, name string, tracks bool) error {
+	st, err := db.NewStorage(cfg, false)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	result, err := db.Backup(ctx, st, f, tracks)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	cfg.L.Info.Printf("backup %v: %v", name, result)
+	return nil
+}
+
+// restoreFile restores storage data from backup archive file.
+func restoreFile(ctx context.Context, cfg *conf.Config, name string) error {
+	st, err := db.NewStorage(cfg, true)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	result, err := db.Restore(ctx, st, f)
+	if err != nil {
+		return err
+	}
+	cfg.L.Info.Printf("restore %v: %v", name, result)
+	return nil
+}
+
+// lockIDs calls a lock function of the node's identifiers block.
+func lockIDs(ctx context.Context, cfg *conf.Config, fn func(ctx context.Context) error) error {
+	ctx, st, err := db.NewCtxStorage(ctx, cfg, true)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	return fn(ctx)
+}
+
 func main() {
 	var err error
 	defer func() {
@@ -69,6 +139,10 @@ func main() {
 	}()
 	version := flag.Bool("version", false, "show version")
 	config := flag.String("config", Config, "configuration file")
+	migrate := flag.Bool("migrate", false, "run pending migrations and exit")
+	backup := flag.String("backup", "", "write backup archive file and exit")
+	restore := flag.String("restore", "", "restore data from backup archive file and exit")
+	tracks := flag.Bool("tracks", false, "include tracks to backup archive")
 	flag.Parse()
 	if *version {
 		fmt.Printf("%v: %v\n\trevision: %v %v\n\tbuild date: %v\n", Name, Version, Revision, runtime.Version(), BuildDate)
@@ -82,24 +156,74 @@ func main() {
 	if err := cfg.Validate(); err != nil {
 		log.Panicf("config validate error [%v]", err)
 	}
-	// check db connection
-	s, err := db.NewSession(cfg.Conn, true)
+	if cfg.Settings.MaxSpam < oldMaxSpam {
+		cfg.L.Error.Printf("settings.maxspam=%v looks like a value of old scale, links with one weak spam signal are rejected", cfg.Settings.MaxSpam)
+	}
+	mainCtx := conf.NewContext(cfg)
+	// check db connection and apply migrations
+	st, err := db.NewStorage(cfg, true)
 	if err != nil {
 		log.Panic(err)
 	}
-	s.Close()
+	n, err := db.Migrate(mainCtx, st, db.LockOwner(cfg.Settings.Node), cfg.LockTTL())
+	st.Close()
 	defer cfg.Close()
+	switch {
+	case err == db.ErrLocked && !*migrate:
+		cfg.L.Info.Println("migrations are applied by other node")
+	case err != nil:
+		log.Panicf("migration error [%v]", err)
+	case n > 0:
+		cfg.L.Info.Printf("%v migration(s) applied", n)
+	}
+	if *migrate {
+		return
+	}
+	switch {
+	case *backup != "":
+		if err := backupFile(mainCtx, cfg, *backup, *tracks); err != nil {
+			log.Panicf("backup error [%v]", err)
+		}
+		return
+	case *restore != "":
+		if err := restoreFile(mainCtx, cfg, *restore); err != nil {
+			log.Panicf("restore error [%v]", err)
+		}
+		return
+	}
 	// init users
-	if err := auth.InitUsers(cfg); err != nil {
+	if err := auth.InitUsers(mainCtx, cfg); err != nil {
 		log.Panic(err)
 	}
+	// identifiers block of the node is used only by this process
+	if err := lockIDs(mainCtx, cfg, trim.LockIDs); err != nil {
+		log.Panicf("identifiers lock error [%v]", err)
+	}
+	defer func() {
+		if err := lockIDs(mainCtx, cfg, trim.ReleaseIDs); err != nil {
+			cfg.L.Error.Printf("identifiers release error: %v", err)
+		}
+	}()
+	go core.IDsWorker(cfg)
+	scorer, err := spam.New(cfg)
+	if err != nil {
+		log.Panicf("spam scorer error [%v]", err)
+	}
 	// set init context
-	mainCtx := conf.NewContext(cfg)
-	mainCtx, err = core.RunWorkers(mainCtx)
+	mainCtx, err = core.RunWorkers(spam.NewContext(mainCtx, scorer))
 	if err != nil {
 		log.Panic(err)
 	}
 	go core.CleanWorker(cfg)
+	if cfg.Settings.Retention > 0 {
+		go core.RollupWorker(cfg)
+	}
+	if cfg.Settings.SpamCheck > 0 {
+		go core.SpamWorker(cfg, scorer)
+	}
+	if cfg.Settings.HealthCheck > 0 {
+		go core.HealthWorker(cfg)
+	}
 	errc := make(chan error)
 	go func() {
 		errc <- interrupt()
@@ -123,6 +247,7 @@ func main() {
 		ErrorLog:       cfg.L.Error,
 	}
 	maxSize := cfg.Settings.MaxReqSize << 20
+	timeout := time.Duration(cfg.Listener.Timeout) * time.Second
 	// static files
 	staticDir, _ := cfg.StaticDir()
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(staticDir))))
@@ -136,6 +261,10 @@ func main() {
 		"/api/info":      {F: api.HandlerInfo, Auth: false, API: true, Method: "GET"},
 		"/api/add":       {F: api.HandlerAdd, Auth: false, API: true, Method: "POST"},
 		"/api/get":       {F: api.HandlerGet, Auth: false, API: true, Method: "POST"},
+		"/api/edit":      {F: api.HandlerEdit, Auth: true, API: true, Method: "POST"},
+		"/api/disable":   {F: api.HandlerDisable, Auth: true, API: true, Method: "POST"},
+		"/api/enable":    {F: api.HandlerEnable, Auth: true, API: true, Method: "POST"},
+		"/api/delete":    {F: api.HandlerDelete, Auth: true, API: true, Method: "POST"},
 		"/api/user/add":  {F: api.HandlerUserAdd, Auth: true, API: true, Method: "POST"},
 		"/api/user/pwd":  {F: api.HandlerPwd, Auth: true, API: true, Method: "POST"},
 		"/api/user/del":  {F: api.HandlerUserDel, Auth: true, API: true, Method: "POST"},
@@ -148,17 +277,19 @@ func main() {
 		if r.URL.Path != path {
 			path = strings.TrimRight(r.URL.Path, "/")
 		}
-		start, code, isAPI := time.Now(), http.StatusOK, false
-		ctx, cancel := context.WithCancel(mainCtx)
+		start, code, isAPI, msg := time.Now(), http.StatusOK, false, ""
+		ctx, cancel := requestContext(mainCtx, r, timeout)
 		defer func() {
 			cancel()
 			switch {
+			case code >= http.StatusMultipleChoices && code < http.StatusBadRequest && !isAPI:
+				// redirection response is already written
 			case code == http.StatusNotFound && !isAPI:
 				core.HandlerNotFound(ctx, w, r)
 			case code != http.StatusOK && !isAPI:
 				core.HandlerError(ctx, w, r)
 			case code != http.StatusOK:
-				if err := api.HandlerError(w, code); err != nil {
+				if err := api.HandlerError(w, code, msg); err != nil {
 					cfg.L.Error.Println(err)
 				}
 			}
@@ -189,15 +320,14 @@ func main() {
 				code = http.StatusUnauthorized
 				return
 			}
-			// open new database session
-			s, err := db.NewSession(cfg.Conn, true)
+			// open new database storage
+			ctx, st, err := db.NewCtxStorage(ctx, cfg, true)
 			if err != nil {
 				cfg.L.Error.Println(err)
 				code = http.StatusInternalServerError
 				return
 			}
-			defer s.Close()
-			ctx = db.NewContext(ctx, s)
+			defer st.Close()
 			// authentication
 			ctx, err = auth.Authenticate(ctx)
 			if err != nil {
@@ -209,26 +339,34 @@ func main() {
 			if err := rh.F(ctx, w, r); err.Err != nil {
 				cfg.L.Error.Println(err)
 				code = err.Status
+				if pe, ok := err.Err.(*trim.PolicyError); ok {
+					// client should know a reason of rejected item
+					msg = pe.Error()
+				}
 				return
 			}
 			return
-		} else if link, ok := trim.IsShort(path); ok {
-			// it's a short URL candidate
-			if r.Method != "GET" {
+		} else if link, suffix, ok := trim.SplitShort(r.URL.EscapedPath()); ok {
+			// it's a short URL candidate,
+			// POST requests are used by password forms
+			if r.Method != "GET" && r.Method != "HEAD" && r.Method != "POST" {
 				code = http.StatusMethodNotAllowed
 				return
 			}
-			origURL, err := core.HandlerRedirect(ctx, link, r)
-			switch {
-			case err == nil:
-				code = http.StatusFound
-				http.Redirect(w, r, origURL, code)
-			case err == mgo.ErrNotFound:
-				code = http.StatusNotFound
-			default:
+			// primary storage is used, because clicks are written here
+			// and edited or disabled links should not be read from lagging secondaries
+			ctx, st, err := db.NewCtxStorage(ctx, cfg, true)
+			if err != nil {
 				cfg.L.Error.Println(err)
 				code = http.StatusInternalServerError
+				return
+			}
+			defer st.Close()
+			result := core.HandlerRedirect(ctx, link, suffix, w, r)
+			if result.Err != nil && result.Status == http.StatusInternalServerError {
+				cfg.L.Error.Println(result)
 			}
+			code = result.Status
 			return
 		}
 		code = http.StatusNotFound
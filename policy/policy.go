@@ -0,0 +1,155 @@
+// Copyright 2016 Alexander Zaytsev <thebestzorro@yandex.ru>
+// Use of this source code is governed by a GPL-style
+// license that can be found in the LICENSE file.
+
+// Package policy implements destination URLs restrictions.
+//
+// Host rules are domain names, wildcards like "*.example.com"
+// or IP networks in CIDR notation like "10.0.0.0/8".
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+)
+
+var (
+	// DefaultSchemes are allowed URL schemes if a policy doesn't set them.
+	DefaultSchemes = []string{"http", "https"}
+	// LocalNets are loopback, private, link-local and other not public networks.
+	LocalNets = []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+	}
+	// local is compiled LocalNets.
+	local = mustCompile(LocalNets)
+)
+
+// rules is a compiled list of host rules.
+type rules struct {
+	hosts []string
+	nets  []*net.IPNet
+}
+
+// Policy is a set of destination URLs restrictions.
+type Policy struct {
+	Schemes []string `json:"schemes"`
+	Allow   []string `json:"allow"`
+	Deny    []string `json:"deny"`
+	Self    bool     `json:"self"`
+	allow   *rules
+	deny    *rules
+}
+
+// compile parses host rules.
+func compile(items []string) (*rules, error) {
+	r := &rules{}
+	for _, item := range items {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if strings.Contains(item, "/") {
+			_, network, err := net.ParseCIDR(item)
+			if err != nil {
+				return nil, err
+			}
+			r.nets = append(r.nets, network)
+			continue
+		}
+		if _, err := path.Match(item, ""); err != nil || item == "" {
+			return nil, fmt.Errorf("invalid host pattern %q", item)
+		}
+		r.hosts = append(r.hosts, item)
+	}
+	return r, nil
+}
+
+// mustCompile is like compile but panics if the rules are invalid.
+func mustCompile(items []string) *rules {
+	r, err := compile(items)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// IsLocal returns true if the IP address belongs to one of LocalNets.
+func IsLocal(ip net.IP) bool {
+	return local.match(ip.String())
+}
+
+// match returns true if the host satisfies one of rules.
+func (r *rules) match(host string) bool {
+	if r == nil {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, network := range r.nets {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	for _, pattern := range r.hosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Init validates and prepares the policy rules.
+func (p *Policy) Init() error {
+	for _, scheme := range p.Schemes {
+		if scheme == "" {
+			return errors.New("empty URL scheme")
+		}
+	}
+	allow, err := compile(p.Allow)
+	if err != nil {
+		return err
+	}
+	deny, err := compile(p.Deny)
+	if err != nil {
+		return err
+	}
+	p.allow, p.deny = allow, deny
+	return nil
+}
+
+// Check verifies that the URL is allowed by the policy,
+// domain is a name of the service domain. Init should be called before.
+func (p *Policy) Check(u *url.URL, domain string) error {
+	schemes := p.Schemes
+	if len(schemes) == 0 {
+		schemes = DefaultSchemes
+	}
+	scheme := strings.ToLower(u.Scheme)
+	allowed := false
+	for _, s := range schemes {
+		if strings.ToLower(s) == scheme {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("URL scheme %q is not allowed", scheme)
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return errors.New("URL host is empty")
+	}
+	if !p.Self && host == strings.ToLower(domain) {
+		return errors.New("links to the service domain are not allowed")
+	}
+	if p.deny.match(host) {
+		return fmt.Errorf("host %q is denied", host)
+	}
+	if len(p.Allow) > 0 && !p.allow.match(host) {
+		return fmt.Errorf("host %q is not allowed", host)
+	}
+	return nil
+}
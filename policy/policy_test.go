@@ -0,0 +1,101 @@
+// Copyright 2016 Alexander Zaytsev <thebestzorro@yandex.ru>
+// Use of this source code is governed by a GPL-style
+// license that can be found in the LICENSE file.
+
+package policy
+
+import (
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestInit(t *testing.T) {
+	suite := []struct {
+		p  *Policy
+		ok bool
+	}{
+		{&Policy{}, true},
+		{&Policy{Schemes: []string{"https"}, Allow: []string{"*.example.com", "10.0.0.0/8"}}, true},
+		{&Policy{Schemes: []string{""}}, false},
+		{&Policy{Deny: []string{"10.0.0.0/33"}}, false},
+		{&Policy{Deny: []string{"[a-"}}, false},
+		{&Policy{Allow: []string{" "}}, false},
+	}
+	for i, v := range suite {
+		if err := v.p.Init(); (err == nil) != v.ok {
+			t.Errorf("invalid behavior [%v]: %v", i, err)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	const domain = "lu.ss"
+	common := &Policy{Deny: []string{"*.evil.com", "evil.com", "192.168.0.0/16"}}
+	restricted := &Policy{
+		Schemes: []string{"https", "ftp"},
+		Allow:   []string{"*.example.com", "10.0.0.0/8"},
+		Self:    true,
+	}
+	for _, p := range []*Policy{common, restricted} {
+		if err := p.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	suite := []struct {
+		p  *Policy
+		u  string
+		ok bool
+	}{
+		{common, "http://github.com/z0rr0/luss", true},
+		{common, "HTTPS://GitHub.com/", true},
+		{common, "javascript:alert(1)", false},
+		{common, "data:text/html;base64,PHNjcmlwdD4=", false},
+		{common, "file:///etc/passwd", false},
+		{common, "ftp://github.com/", false},
+		{common, "http://lu.ss/abc", false},
+		{common, "http://LU.SS:8080/abc", false},
+		{common, "http://evil.com/", false},
+		{common, "http://a.b.evil.com/", false},
+		{common, "http://notevil.com/", true},
+		{common, "http://192.168.1.1/", false},
+		{common, "http://10.1.1.1/", true},
+		{restricted, "https://www.example.com/", true},
+		{restricted, "ftp://files.example.com/", true},
+		{restricted, "http://www.example.com/", false},
+		{restricted, "https://example.com/", false},
+		{restricted, "https://github.com/", false},
+		{restricted, "https://10.1.1.1/", true},
+		{restricted, "https://lu.ss/", false},
+	}
+	for i, v := range suite {
+		u, err := url.Parse(v.u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := v.p.Check(u, domain); (err == nil) != v.ok {
+			t.Errorf("invalid behavior [%v]: %v", i, err)
+		}
+	}
+}
+
+func TestIsLocal(t *testing.T) {
+	suite := map[string]bool{
+		"127.0.0.1":        true,
+		"10.1.2.3":         true,
+		"172.20.0.1":       true,
+		"192.168.1.1":      true,
+		"169.254.169.254":  true,
+		"0.0.0.0":          true,
+		"::1":              true,
+		"fd00::1":          true,
+		"::ffff:127.0.0.1": true,
+		"8.8.8.8":          false,
+		"2001:4860::8888":  false,
+	}
+	for addr, expected := range suite {
+		if IsLocal(net.ParseIP(addr)) != expected {
+			t.Errorf("invalid behavior [%v]", addr)
+		}
+	}
+}
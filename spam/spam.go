@@ -0,0 +1,222 @@
+// Copyright 2016 Alexander Zaytsev <thebestzorro@yandex.ru>
+// Use of this source code is governed by a GPL-style
+// license that can be found in the LICENSE file.
+
+// Package spam implements methods to calculate spam score of short URLs.
+//
+// Score is a value from 0 (clean link) to 100 (definitely spam),
+// it is compared with "maxspam" setting.
+package spam
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/z0rr0/luss/auth"
+	"github.com/z0rr0/luss/conf"
+	"github.com/z0rr0/luss/db"
+)
+
+const (
+	// MaxScore is max spam score value.
+	MaxScore = 100.0
+	// Disable is an action to deactivate spam short URLs.
+	Disable = "disable"
+	// Preview is an action to show a warning page before spam short URL redirect.
+	Preview = "preview"
+	// reputationMin is min number of user's short URLs to calculate a reputation.
+	reputationMin = 5
+	// scorerKey is a context key of spam scorer.
+	scorerKey key = 0
+)
+
+var (
+	// Shorteners is a list of known URL shortening services domains.
+	Shorteners = []string{
+		"bit.ly", "goo.gl", "t.co", "tinyurl.com", "ow.ly", "is.gd",
+		"buff.ly", "adf.ly", "bit.do", "cutt.ly", "shorturl.at", "rebrand.ly",
+	}
+	// TLDs is a list of top-level domains which are often used by spammers.
+	TLDs = []string{
+		"tk", "ml", "ga", "cf", "gq", "xyz", "top", "work", "click", "loan", "zip", "country",
+	}
+)
+
+type key int
+
+// Link is short URL data to calculate its spam score.
+type Link struct {
+	URL   string
+	User  string
+	Group string
+}
+
+// Scorer calculates spam score of a link.
+type Scorer interface {
+	Score(ctx context.Context, link *Link) (float64, error)
+}
+
+// Multi is a scorer that sums scores of its items.
+type Multi []Scorer
+
+// Score returns a sum of items' scores, it's not greater than MaxScore.
+func (m Multi) Score(ctx context.Context, link *Link) (float64, error) {
+	var score float64
+	for _, s := range m {
+		v, err := s.Score(ctx, link)
+		if err != nil {
+			return 0, err
+		}
+		score += v
+		if score >= MaxScore {
+			return MaxScore, nil
+		}
+	}
+	return score, nil
+}
+
+// Blocklist is a scorer that marks links to blocked domains and their subdomains as spam.
+type Blocklist map[string]bool
+
+// Score returns MaxScore if the link's domain is blocked.
+func (b Blocklist) Score(ctx context.Context, link *Link) (float64, error) {
+	u, err := url.Parse(link.URL)
+	if err != nil {
+		return 0, err
+	}
+	parts := strings.Split(strings.ToLower(u.Hostname()), ".")
+	for i := range parts {
+		if b[strings.Join(parts[i:], ".")] {
+			return MaxScore, nil
+		}
+	}
+	return 0, nil
+}
+
+// Heuristics is a scorer that checks suspicious properties of links:
+// shortener chains, IP literals, suspicious top-level domains and user info.
+type Heuristics struct {
+	Shorteners map[string]bool
+	TLDs       map[string]bool
+}
+
+// Score returns a sum of weights of found suspicious properties.
+func (h *Heuristics) Score(ctx context.Context, link *Link) (float64, error) {
+	var score float64
+	u, err := url.Parse(link.URL)
+	if err != nil {
+		return 0, err
+	}
+	host := strings.ToLower(u.Hostname())
+	if h.Shorteners[strings.TrimPrefix(host, "www.")] {
+		// shortener chain hides a real destination
+		score += 40
+	}
+	if net.ParseIP(host) != nil {
+		score += 30
+	}
+	if i := strings.LastIndex(host, "."); i >= 0 && h.TLDs[host[i+1:]] {
+		score += 20
+	}
+	if u.User != nil {
+		// http://trusted.com@evil.com/
+		score += 20
+	}
+	if strings.Contains(host, "xn--") {
+		score += 10
+	}
+	return score, nil
+}
+
+// Reputation is a scorer that uses a share of user's spam links,
+// a storage from the context is used. Anonymous users share one account,
+// so their reputation is not used.
+type Reputation struct {
+	Max float64
+}
+
+// Score returns a score proportional to the share of user's spam links.
+func (r *Reputation) Score(ctx context.Context, link *Link) (float64, error) {
+	if link.User == auth.Anonymous {
+		return 0, nil
+	}
+	st, err := db.CtxStorage(ctx)
+	if err != nil {
+		return 0, err
+	}
+	total, n, err := st.CountSpam(ctx, link.User, r.Max)
+	if err != nil {
+		return 0, err
+	}
+	if total < reputationMin {
+		return 0, nil
+	}
+	return MaxScore / 2 * float64(n) / float64(total), nil
+}
+
+// set returns a set of lower case values.
+func set(values []string) map[string]bool {
+	result := make(map[string]bool, len(values))
+	for _, v := range values {
+		result[strings.ToLower(v)] = true
+	}
+	return result
+}
+
+// ReadBlocklist reads domains from the file, one domain per line,
+// empty lines and lines started with "#" are skipped.
+func ReadBlocklist(name string) (Blocklist, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b := Blocklist{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		b[strings.ToLower(line)] = true
+	}
+	return b, scanner.Err()
+}
+
+// New returns default scorer: blocklists from the configuration,
+// heuristics and users' reputation.
+func New(c *conf.Config) (Scorer, error) {
+	blocklist := Blocklist{}
+	for _, name := range c.Settings.SpamLists {
+		b, err := ReadBlocklist(name)
+		if err != nil {
+			return nil, err
+		}
+		for domain := range b {
+			blocklist[domain] = true
+		}
+	}
+	h := &Heuristics{Shorteners: set(Shorteners), TLDs: set(TLDs)}
+	// this service is also a shortener
+	h.Shorteners[strings.ToLower(c.Domain.Name)] = true
+	return Multi{blocklist, h, &Reputation{Max: float64(c.Settings.MaxSpam)}}, nil
+}
+
+// NewContext returns new context with the scorer.
+func NewContext(ctx context.Context, s Scorer) context.Context {
+	return context.WithValue(ctx, scorerKey, s)
+}
+
+// FromContext extracts the scorer from the context.
+func FromContext(ctx context.Context) (Scorer, error) {
+	s, ok := ctx.Value(scorerKey).(Scorer)
+	if !ok {
+		return nil, errors.New("not found context spam scorer")
+	}
+	return s, nil
+}
@@ -15,13 +15,15 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/z0rr0/luss/conf"
 	"github.com/z0rr0/luss/db"
 	"github.com/z0rr0/luss/trim"
-	"gopkg.in/mgo.v2/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 const (
@@ -45,19 +47,37 @@ type GeoData struct {
 
 // Track is information about users requests.
 type Track struct {
-	ID      bson.ObjectId `bson:"_id"`
-	Short   string        `bson:"short"`
-	URL     string        `bson:"url"`
-	Group   string        `bson:"group"`
-	Tag     string        `bson:"tag"`
-	Geo     GeoData       `bson:"geo"`
-	Created time.Time     `bson:"ts"`
+	ID      primitive.ObjectID `bson:"_id"`
+	Short   string             `bson:"short"`
+	URL     string             `bson:"url"`
+	Group   string             `bson:"group"`
+	Tag     string             `bson:"tag"`
+	Geo     GeoData            `bson:"geo"`
+	Access  string             `bson:"access,omitempty"`
+	Variant int                `bson:"variant,omitempty"`
+	Created time.Time          `bson:"ts"`
 }
 
 // Callback is a callback handler.
 // It does HTTP request if it's needed.
 func Callback(ctx context.Context, cu *trim.CustomURL) error {
-	req, err := cu.Callback()
+	return callback(cu, nil)
+}
+
+// HealthCallback notifies about failed checks of the original URL,
+// it sends the short URL callback with health parameters.
+func HealthCallback(ctx context.Context, cu *trim.CustomURL) error {
+	extra := url.Values{"event": {"health"}}
+	if cu.Health != nil {
+		extra.Set("status", strconv.Itoa(cu.Health.Status))
+		extra.Set("fails", strconv.Itoa(cu.Health.Fails))
+	}
+	return callback(cu, extra)
+}
+
+// callback does HTTP request of the short URL callback.
+func callback(cu *trim.CustomURL, extra url.Values) error {
+	req, err := cu.Callback(extra)
 	if err != nil {
 		// empty callback
 		if err == trim.ErrEmptyCallback {
@@ -83,10 +103,14 @@ func Callback(ctx context.Context, cu *trim.CustomURL) error {
 	return err
 }
 
-// Tracker saves info about short URL activities.
+// Tracker saves info about short URL activities,
+// it uses a data storage from the context.
+// Target is an URL that was actually served (the original one if it's empty),
+// access is a result of password check for protected short URLs,
+// variant is a number of served target of short URL with several ones.
 // GeoIP database can be loaded from
 // http://geolite.maxmind.com/download/geoip/database/GeoLite2-City.mmdb.gz
-func Tracker(ctx context.Context, cu *trim.CustomURL, addr string) error {
+func Tracker(ctx context.Context, cu *trim.CustomURL, addr, target, access string, variant int) error {
 	c, err := conf.FromContext(ctx)
 	if err != nil {
 		return err
@@ -107,22 +131,23 @@ func Tracker(ctx context.Context, cu *trim.CustomURL, addr string) error {
 		geo.Longitude = record.Location.Longitude
 		geo.Tz = record.Location.TimeZone
 	}
-	s, err := db.NewSession(c.Conn, true)
+	st, err := db.CtxStorage(ctx)
 	if err != nil {
 		return err
 	}
-	defer s.Close()
-	coll, err := db.Coll(s, "tracks")
-	if err != nil {
-		return err
+	if target == "" {
+		target = cu.Original
 	}
-	err = coll.Insert(bson.M{
-		"short": cu.String(),
-		"url":   cu.Original,
-		"group": cu.Group,
-		"tag":   cu.Tag,
-		"geo":   geo,
-		"ts":    time.Now().UTC(),
-	})
-	return err
+	track := &Track{
+		ID:      primitive.NewObjectID(),
+		Short:   cu.String(),
+		URL:     target,
+		Group:   cu.Group,
+		Tag:     cu.Tag,
+		Geo:     geo,
+		Access:  access,
+		Variant: variant,
+		Created: time.Now().UTC(),
+	}
+	return st.InsertTrack(ctx, track)
 }
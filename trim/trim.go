@@ -9,43 +9,95 @@ package trim
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"log"
 	"math"
+	"math/big"
+	mrand "math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/z0rr0/luss/auth"
 	"github.com/z0rr0/luss/conf"
 	"github.com/z0rr0/luss/db"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"github.com/z0rr0/luss/device"
+	"github.com/z0rr0/luss/spam"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const (
 	// Alphabet is a sorted set of basis numeral system chars.
 	Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	// randomAttempts is max number of attempts to save random short URL.
+	randomAttempts = 5
+	// maxPassword is max password length, bcrypt doesn't use longer values.
+	maxPassword = 72
+	// maxTargets is max number of weighted targets of short URL.
+	maxTargets = 16
+	// maxGeoRules is max number of geo rules of short URL.
+	maxGeoRules = 32
+	// QueryAppend and QueryMerge are modes of request query passthrough,
+	// the query is appended to the original one as is or its parameters are merged.
+	QueryAppend = "append"
+	QueryMerge  = "merge"
 )
 
 var (
 	// ErrEmptyCallback is error about empty empty callback usage.
 	ErrEmptyCallback = errors.New("empty callback request")
+	// ErrAliasUsed is error when requested alias is already used.
+	ErrAliasUsed = errors.New("alias is already used")
+	// ErrSpam is error when URL's spam score is greater than allowed one.
+	ErrSpam = errors.New("spam URL")
+	// errProtectedCode is error of redirect code which repeats password form request.
+	errProtectedCode = errors.New("redirect code is not allowed for protected link")
+	// errInvalidValue is error of URL which can't be normalized.
+	errInvalidValue = errors.New("invalid value")
+	// isCountry is regexp pattern to check ISO 3166-1 alpha-2 country code.
+	isCountry = regexp.MustCompile(`^[A-Z]{2}$`)
 	// isShortURL is regexp pattern to check short URL,
 	// max int64 9223372036854775807 => AzL8n0Y58m7
 	// real, max decode/encode 839299365868340223 <=> zzzzzzzzzz
 	isShortURL = regexp.MustCompile(fmt.Sprintf("^[%s]{1,10}$", Alphabet))
+	// isAlias is regexp pattern to check custom alias of short URL,
+	// an alias should not match isShortURL pattern.
+	isAlias = regexp.MustCompile("^[0-9A-Za-z][0-9A-Za-z_-]{0,63}$")
+	// reservedAliases are first parts of service's paths,
+	// they can not be used as aliases.
+	reservedAliases = map[string]bool{
+		"api":    true,
+		"static": true,
+		"test":   true,
+		"error":  true,
+	}
 	// logger is a logger for error messages
 	logger = log.New(os.Stderr, "LOGGER [trim]: ", log.Ldate|log.Ltime|log.Lshortfile)
 	// basis is a numeral system basis
 	basis = int64(len(Alphabet))
+	// ids is a local block of short URLs identifiers.
+	ids = &idBlock{}
 )
 
+// idBlock is a block of short URLs identifiers leased by the node,
+// they are handed out locally without database requests (hi/lo allocation).
+// The block is protected by the node's distributed lock,
+// so only one process of the node can use it.
+type idBlock struct {
+	sync.Mutex
+	loaded bool
+	next   int64
+	hi     int64
+	expire time.Time
+}
+
 // CallBack is callback info.
 type CallBack struct {
 	URL    string `bson:"u"`
@@ -56,19 +108,57 @@ type CallBack struct {
 
 // CustomURL stores info about user's URL.
 type CustomURL struct {
-	ID        int64      `bson:"_id"`
-	Disabled  bool       `bson:"off"`
-	Group     string     `bson:"group"`
-	Tag       string     `bson:"tag"`
-	Original  string     `bson:"orig"`
-	User      string     `bson:"u"`
-	TTL       *time.Time `bson:"ttl"`
-	NotDirect bool       `bson:"ndr"`
-	Spam      float64    `bson:"spam"`
-	Created   time.Time  `bson:"ts"`
-	Modified  time.Time  `bson:"mod"`
-	Cb        CallBack   `bson:"cb"`
-	API       bool       `bson:"api"`
+	ID        int64         `bson:"_id"`
+	Alias     string        `bson:"alias,omitempty"`
+	Disabled  bool          `bson:"off"`
+	Reason    string        `bson:"why,omitempty"`
+	Group     string        `bson:"group"`
+	Tag       string        `bson:"tag"`
+	Original  string        `bson:"orig"`
+	Norm      string        `bson:"norm,omitempty"`
+	User      string        `bson:"u"`
+	TTL       *time.Time    `bson:"ttl"`
+	MaxClicks int64         `bson:"max,omitempty"`
+	Left      int64         `bson:"left,omitempty"`
+	NotDirect bool          `bson:"ndr"`
+	Spam      float64       `bson:"spam"`
+	Health    *Health       `bson:"health,omitempty"`
+	Targets   []Target      `bson:"targets,omitempty"`
+	Sticky    bool          `bson:"sticky,omitempty"`
+	Geo       []GeoRule     `bson:"geo,omitempty"`
+	Devices   []device.Rule `bson:"devices,omitempty"`
+	Query     string        `bson:"query,omitempty"`
+	Suffix    bool          `bson:"suffix,omitempty"`
+	Code      int           `bson:"code,omitempty"`
+	Created   time.Time     `bson:"ts"`
+	Modified  time.Time     `bson:"mod"`
+	Deleted   *time.Time    `bson:"del,omitempty"`
+	Password  string        `bson:"pwd,omitempty"`
+	Cb        CallBack      `bson:"cb"`
+	API       bool          `bson:"api"`
+	Reused    bool          `bson:"-"`
+}
+
+// Target is a weighted destination of short URL with several ones.
+type Target struct {
+	URL    string `bson:"url"`
+	Weight int    `bson:"w"`
+}
+
+// GeoRule is a destination of short URL for clients from the countries,
+// countries are ISO 3166-1 alpha-2 codes.
+type GeoRule struct {
+	Countries []string `bson:"countries"`
+	URL       string   `bson:"url"`
+}
+
+// Health is a result of original URL availability checks.
+type Health struct {
+	Status  int       `bson:"status"`
+	Err     string    `bson:"err,omitempty"`
+	Checked time.Time `bson:"ts"`
+	Fails   int       `bson:"fails"`
+	Flagged bool      `bson:"flag"`
 }
 
 // Filter is a data filter to export URLs info.
@@ -85,34 +175,341 @@ type Filter struct {
 // short URL creation.
 type ReqParams struct {
 	Original  string
+	Alias     string
 	Tag       string
 	Group     string
+	Random    bool
+	Dedup     bool
 	NotDirect bool
 	IsAPI     bool
 	TTL       *time.Time
+	MaxClicks int64
+	Password  string
+	Targets   []Target
+	Sticky    bool
+	Geo       []GeoRule
+	Devices   []device.Rule
+	Query     string
+	Suffix    bool
+	Code      int
 	Cb        CallBack
+	// Fields are settings of edit request, other ones aren't changed.
+	// All fields are used if it's zero.
+	Fields Field
 }
 
+// Field is a flag of short URL setting which is changed by edit request.
+type Field uint
+
+// Editable fields of short URLs.
+const (
+	FieldURL Field = 1 << iota
+	FieldTag
+	FieldGroup
+	FieldTTL
+	FieldClicks
+	FieldPassword
+	FieldNotDirect
+	FieldTargets
+	FieldSticky
+	FieldGeo
+	FieldDevices
+	FieldQuery
+	FieldSuffix
+	FieldCode
+	FieldCb
+)
+
 // ChangeResult is result of CustomURL pack change.
 type ChangeResult struct {
 	Cu  *CustomURL
 	Err string
 }
 
-// String returns short string URL without domain prefix.
+// String returns short string URL without domain prefix,
+// it is an alias if it exists.
 func (cu *CustomURL) String() string {
+	if cu.Alias != "" {
+		return cu.Alias
+	}
 	return Encode(cu.ID)
 }
 
+// RandomID returns a random short URL identifier, its string form has
+// fixed length n, so it's not less than db.RandomMin for n > 6.
+func RandomID(n int) (int64, error) {
+	code := make([]byte, n)
+	for i := range code {
+		lo := 0
+		if i == 0 {
+			// leading zero is lost after decoding
+			lo = 1
+		}
+		k, err := rand.Int(rand.Reader, big.NewInt(int64(len(Alphabet)-lo)))
+		if err != nil {
+			return 0, err
+		}
+		code[i] = Alphabet[lo+int(k.Int64())]
+	}
+	return Decode(string(code))
+}
+
+// Protected returns true if short URL requires a password.
+func (cu *CustomURL) Protected() bool {
+	return cu.Password != ""
+}
+
+// KeepsMethod returns true if the redirect code makes clients repeat
+// the request method and body.
+func KeepsMethod(code int) bool {
+	return code == http.StatusTemporaryRedirect || code == http.StatusPermanentRedirect
+}
+
+// Expired returns true if TTL of short URL is over.
+func (cu *CustomURL) Expired() bool {
+	return cu.TTL != nil && !cu.TTL.After(time.Now())
+}
+
+// Temporary returns true if short URL can be changed or deactivated automatically,
+// or its destination depends on a client, so redirects to it shouldn't be cached.
+func (cu *CustomURL) Temporary() bool {
+	rules := len(cu.Targets) + len(cu.Geo) + len(cu.Devices)
+	return cu.TTL != nil || cu.MaxClicks > 0 || cu.Protected() || rules > 0
+}
+
+// CheckPassword verifies a password of protected short URL.
+func (cu *CustomURL) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(cu.Password), []byte(password)) == nil
+}
+
+// hashPassword returns bcrypt hash of not empty password.
+func hashPassword(password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(h), nil
+}
+
+// PolicyError is error of destination URL policy check.
+type PolicyError struct {
+	Item int
+	Err  error
+}
+
+// Error returns a message with index of failed request item.
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("item %v: %v", e.Item, e.Err)
+}
+
+// CheckPolicy verifies the original and targets URLs
+// using destination policy of the group.
+func CheckPolicy(c *conf.Config, rp *ReqParams) error {
+	return checkURLs(c, rp.Group, rp.URLs())
+}
+
+// checkURLs verifies URLs using destination policy of the group.
+func checkURLs(c *conf.Config, group string, urls []string) error {
+	p := c.URLPolicy(group)
+	for _, rawurl := range urls {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return err
+		}
+		if err := p.Check(u, c.Domain.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsSpam returns true if spam score of short URL is greater than max value.
+func (cu *CustomURL) IsSpam(c *conf.Config) bool {
+	return cu.Spam > float64(c.Settings.MaxSpam)
+}
+
+// spamScore returns max spam score of URLs,
+// it's zero if the context doesn't contain a scorer.
+func spamScore(ctx context.Context, urls []string, user, group string) (float64, error) {
+	scorer, err := spam.FromContext(ctx)
+	if err != nil {
+		return 0, nil
+	}
+	return maxScore(ctx, scorer, urls, user, group)
+}
+
+// SpamScore returns max spam score of all destination URLs of short URL.
+func (cu *CustomURL) SpamScore(ctx context.Context, scorer spam.Scorer) (float64, error) {
+	return maxScore(ctx, scorer, cu.URLs(), cu.User, cu.Group)
+}
+
+// maxScore returns max spam score of URLs.
+func maxScore(ctx context.Context, scorer spam.Scorer, urls []string, user, group string) (float64, error) {
+	var max float64
+	for _, rawurl := range urls {
+		score, err := scorer.Score(ctx, &spam.Link{URL: rawurl, User: user, Group: group})
+		if err != nil {
+			return 0, err
+		}
+		if score > max {
+			max = score
+		}
+	}
+	return max, nil
+}
+
+// Forward returns the destination URL with the request path suffix and query
+// if short URL options allow them. In merge mode the request parameters
+// replace the same destination ones only if requestWins is true.
+func (cu *CustomURL) Forward(destination, suffix, query string, requestWins bool) (string, error) {
+	if (!cu.Suffix || suffix == "") && (cu.Query == "" || query == "") {
+		return destination, nil
+	}
+	u, err := url.Parse(destination)
+	if err != nil {
+		return "", err
+	}
+	if cu.Suffix && suffix != "" {
+		p, err := url.PathUnescape(suffix)
+		if err != nil {
+			return "", err
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/") + p
+		u.RawPath = ""
+	}
+	switch {
+	case query == "":
+		// nothing to forward
+	case cu.Query == QueryAppend:
+		if u.RawQuery != "" {
+			u.RawQuery += "&"
+		}
+		u.RawQuery += query
+	case cu.Query == QueryMerge:
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			return "", err
+		}
+		params := u.Query()
+		for k, v := range values {
+			if _, ok := params[k]; ok && !requestWins {
+				continue
+			}
+			params[k] = v
+		}
+		u.RawQuery = params.Encode()
+	}
+	return u.String(), nil
+}
+
+// GeoURL returns URL of the first geo rule that contains the country.
+func (cu *CustomURL) GeoURL(country string) (string, bool) {
+	if country == "" {
+		return "", false
+	}
+	for _, rule := range cu.Geo {
+		for _, c := range rule.Countries {
+			if c == country {
+				return rule.URL, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Destination returns a variant number and URL of short URL destination.
+// Variant is zero if short URL doesn't have targets, otherwise it's
+// a number of weighted random target starting from 1. Previous variant
+// is used if it's valid, so visitors can get the same target.
+func (cu *CustomURL) Destination(previous int) (int, string) {
+	var total int
+	n := len(cu.Targets)
+	if n == 0 {
+		return 0, cu.Original
+	}
+	if previous > 0 && previous <= n {
+		return previous, cu.Targets[previous-1].URL
+	}
+	for _, t := range cu.Targets {
+		total += t.Weight
+	}
+	if total < 1 {
+		return 0, cu.Original
+	}
+	x := mrand.Intn(total)
+	for i, t := range cu.Targets {
+		if x < t.Weight {
+			return i + 1, t.URL
+		}
+		x -= t.Weight
+	}
+	return n, cu.Targets[n-1].URL
+}
+
+// Keys returns all short strings of URL, they are used as cache keys.
+func (cu *CustomURL) Keys() []string {
+	keys := []string{Encode(cu.ID)}
+	if cu.Alias != "" {
+		keys = append(keys, cu.Alias)
+	}
+	return keys
+}
+
+// ValidAlias checks that custom alias can be used for short URL.
+func ValidAlias(alias string) error {
+	switch {
+	case !isAlias.MatchString(alias):
+		return errors.New("invalid alias")
+	case reservedAliases[strings.ToLower(alias)]:
+		return errors.New("reserved alias")
+	case isShortURL.MatchString(alias):
+		return errors.New("alias can not be like generated short URL, use '-' or '_' or more than 10 symbols")
+	}
+	return nil
+}
+
 // String returns request info.
 func (rp *ReqParams) String() string {
 	return rp.Original
 }
 
+// URLs returns the original URL and URLs of targets.
+func (rp *ReqParams) URLs() []string {
+	return destinations(rp.Original, rp.Targets, rp.Geo, rp.Devices)
+}
+
+// URLs returns the original URL and URLs of targets, geo and device rules.
+func (cu *CustomURL) URLs() []string {
+	return destinations(cu.Original, cu.Targets, cu.Geo, cu.Devices)
+}
+
+// destinations returns all URLs which can be served by a short URL.
+func destinations(original string, targets []Target, geo []GeoRule, devices []device.Rule) []string {
+	urls := []string{original}
+	for _, t := range targets {
+		urls = append(urls, t.URL)
+	}
+	for _, rule := range geo {
+		urls = append(urls, rule.URL)
+	}
+	for _, rule := range devices {
+		urls = append(urls, rule.URL)
+	}
+	return urls
+}
+
+// has returns true if the field is used by request.
+func (rp *ReqParams) has(f Field) bool {
+	return rp.Fields == 0 || rp.Fields&f != 0
+}
+
 // Valid checks ReqParams values.
 func (rp *ReqParams) Valid() error {
 	const lenLimit = 255
-	if rp.Original == "" {
+	if rp.has(FieldURL) && rp.Original == "" {
 		return errors.New("empty request parameters")
 	}
 	if len(rp.Tag) > lenLimit {
@@ -121,16 +518,96 @@ func (rp *ReqParams) Valid() error {
 	if len(rp.Group) > lenLimit {
 		return errors.New("too long group name")
 	}
-	u, err := url.Parse(rp.Original)
-	if err != nil {
+	if rp.Alias != "" {
+		if err := ValidAlias(rp.Alias); err != nil {
+			return err
+		}
+	}
+	if rp.MaxClicks < 0 {
+		return errors.New("negative clicks limit")
+	}
+	if len(rp.Password) > maxPassword {
+		return errors.New("too long password")
+	}
+	if rp.has(FieldURL) {
+		u, err := url.Parse(rp.Original)
+		if err != nil {
+			return err
+		}
+		if !u.IsAbs() {
+			return errors.New("not absolute URL")
+		}
+		rp.Original = u.String()
+	}
+	if len(rp.Targets) > maxTargets {
+		return fmt.Errorf("too many targets, max %v", maxTargets)
+	}
+	for i := range rp.Targets {
+		t := &rp.Targets[i]
+		if t.Weight < 0 {
+			return errors.New("negative target weight")
+		}
+		if t.Weight == 0 {
+			t.Weight = 1
+		}
+		u, err := url.Parse(t.URL)
+		if err != nil {
+			return err
+		}
+		if !u.IsAbs() {
+			return errors.New("not absolute target URL")
+		}
+		t.URL = u.String()
+	}
+	if len(rp.Geo) > maxGeoRules {
+		return fmt.Errorf("too many geo rules, max %v", maxGeoRules)
+	}
+	for i := range rp.Geo {
+		rule := &rp.Geo[i]
+		if len(rule.Countries) == 0 {
+			return errors.New("empty countries of geo rule")
+		}
+		for j, country := range rule.Countries {
+			country = strings.ToUpper(country)
+			if !isCountry.MatchString(country) {
+				return fmt.Errorf("invalid country code [%v]", rule.Countries[j])
+			}
+			rule.Countries[j] = country
+		}
+		u, err := url.Parse(rule.URL)
+		if err != nil {
+			return err
+		}
+		if !u.IsAbs() {
+			return errors.New("not absolute geo rule URL")
+		}
+		rule.URL = u.String()
+	}
+	if rp.Query != "" && rp.Query != QueryAppend && rp.Query != QueryMerge {
+		return fmt.Errorf("unknown query mode [%v]", rp.Query)
+	}
+	if rp.Code != 0 && !conf.ValidRedirect(rp.Code) {
+		return fmt.Errorf("unknown redirect code [%v]", rp.Code)
+	}
+	if rp.Password != "" && KeepsMethod(rp.Code) {
+		// password form would be re-sent to the destination
+		return fmt.Errorf("redirect code [%v] is not allowed for protected links", rp.Code)
+	}
+	if err := device.Check(rp.Devices); err != nil {
 		return err
 	}
-	if !u.IsAbs() {
-		return errors.New("not absolute URL")
+	for i := range rp.Devices {
+		u, err := url.Parse(rp.Devices[i].URL)
+		if err != nil {
+			return err
+		}
+		if !u.IsAbs() {
+			return errors.New("not absolute device rule URL")
+		}
+		rp.Devices[i].URL = u.String()
 	}
-	rp.Original = u.String()
 	if rp.Cb.URL != "" {
-		u, err = url.Parse(rp.Cb.URL)
+		u, err := url.Parse(rp.Cb.URL)
 		if err != nil {
 			return err
 		}
@@ -145,8 +622,9 @@ func (rp *ReqParams) Valid() error {
 	return nil
 }
 
-// Callback returns a prepared body request Reader as bytes.Buffer pointer.
-func (cu *CustomURL) Callback() (*http.Request, error) {
+// Callback returns a prepared callback request,
+// extra parameters are added to the request body.
+func (cu *CustomURL) Callback(extra url.Values) (*http.Request, error) {
 	if cu.Cb.URL == "" {
 		return nil, ErrEmptyCallback
 	}
@@ -159,6 +637,11 @@ func (cu *CustomURL) Callback() (*http.Request, error) {
 	}
 	params.Add("id", cu.String())
 	params.Add("tag", cu.Tag)
+	for k, values := range extra {
+		for _, v := range values {
+			params.Add(k, v)
+		}
+	}
 	body := bytes.NewBufferString(params.Encode())
 	return http.NewRequest(cu.Cb.Method, cu.Cb.URL, body)
 }
@@ -168,18 +651,145 @@ func (cb *CallBack) String() string {
 	return fmt.Sprintf("%v:%v", cb.Method, cb.URL)
 }
 
-// getMax returns a max short URLs, so it should be called
-// in locked primary mode to get actual data.
-func getMax(coll *mgo.Collection) (int64, error) {
-	maxURL := &db.ItemURL{}
-	err := coll.Find(nil).Sort("-_id").Limit(1).One(maxURL)
+// load restores identifiers block of the node after its restart,
+// so only used identifiers of the last lease are skipped.
+func (b *idBlock) load(ctx context.Context, st db.Storage, node string) error {
+	lease, err := st.FindLease(ctx, node)
+	switch {
+	case err == db.ErrNotFound:
+		// the node has not any lease yet
+		b.next, b.hi = 0, 0
+	case err != nil:
+		return err
+	default:
+		used, err := st.MaxURLIn(ctx, lease.Lo, lease.Hi)
+		if err != nil {
+			return err
+		}
+		b.next, b.hi = used+1, lease.Hi
+	}
+	b.loaded = true
+	return nil
+}
+
+// lock acquires or renews the node's lock of identifiers block,
+// the block is reloaded if the lock was lost.
+func (b *idBlock) lock(ctx context.Context, st db.Storage, c *conf.Config) error {
+	now := time.Now()
+	ttl := c.LockTTL()
+	if b.loaded && now.Before(b.expire.Add(-ttl/2)) {
+		// the lock is still valid
+		return nil
+	}
+	key, owner := "ids:"+c.Settings.Node, db.LockOwner(c.Settings.Node)
+	if b.loaded {
+		if err := st.RenewLock(ctx, key, owner, ttl); err == nil {
+			b.expire = now.Add(ttl)
+			return nil
+		}
+		// other process could use the block
+		b.loaded = false
+	}
+	if err := st.AcquireLock(ctx, key, owner, ttl); err != nil {
+		return err
+	}
+	b.expire = now.Add(ttl)
+	return b.load(ctx, st, c.Settings.Node)
+}
+
+// release releases the node's lock of identifiers block,
+// so the node can be restarted without waiting of the lock expiration.
+func (b *idBlock) release(ctx context.Context, st db.Storage, c *conf.Config) error {
+	if !b.loaded {
+		return nil
+	}
+	b.loaded = false
+	return st.ReleaseLock(ctx, "ids:"+c.Settings.Node, db.LockOwner(c.Settings.Node))
+}
+
+// reserve returns n identifiers, new block is leased if the current one is exhausted.
+func (b *idBlock) reserve(ctx context.Context, st db.Storage, c *conf.Config, n int) ([]int64, error) {
+	b.Lock()
+	defer b.Unlock()
+	if err := b.lock(ctx, st, c); err != nil {
+		return nil, fmt.Errorf("identifiers block of node %v: %v", c.Settings.Node, err)
+	}
+	result := make([]int64, 0, n)
+	for len(result) < n {
+		if b.next == 0 || b.next > b.hi {
+			need := n - len(result)
+			if need < c.IDBlock() {
+				need = c.IDBlock()
+			}
+			lease, err := st.LeaseURLs(ctx, c.Settings.Node, need)
+			if err != nil {
+				return nil, err
+			}
+			b.next, b.hi = lease.Lo, lease.Hi
+		}
+		result = append(result, b.next)
+		b.next++
+	}
+	return result, nil
+}
+
+// LockIDs acquires the node's identifiers block at the process start.
+// A lock of crashed process is waited until its expiration,
+// so the error means that other running process has the same node name.
+func LockIDs(ctx context.Context) error {
+	c, err := conf.FromContext(ctx)
 	if err != nil {
-		if err == mgo.ErrNotFound {
-			return 0, nil
+		return err
+	}
+	st, err := db.CtxStorage(ctx)
+	if err != nil {
+		return err
+	}
+	ids.Lock()
+	defer ids.Unlock()
+	deadline := time.Now().Add(c.LockTTL())
+	for {
+		err = ids.lock(ctx, st, c)
+		if err != db.ErrLocked || time.Now().After(deadline) {
+			break
 		}
-		return 0, err
+		time.Sleep(time.Second)
 	}
-	return maxURL.ID, nil
+	if err == db.ErrLocked {
+		return fmt.Errorf("node name %v is used by other process", c.Settings.Node)
+	}
+	return err
+}
+
+// RenewIDs prolongs the node's identifiers block lock,
+// it keeps the lock of idle process.
+func RenewIDs(ctx context.Context) error {
+	c, err := conf.FromContext(ctx)
+	if err != nil {
+		return err
+	}
+	st, err := db.CtxStorage(ctx)
+	if err != nil {
+		return err
+	}
+	ids.Lock()
+	defer ids.Unlock()
+	return ids.lock(ctx, st, c)
+}
+
+// ReleaseIDs releases the node's identifiers block lock on the process shutdown.
+func ReleaseIDs(ctx context.Context) error {
+	c, err := conf.FromContext(ctx)
+	if err != nil {
+		return err
+	}
+	st, err := db.CtxStorage(ctx)
+	if err != nil {
+		return err
+	}
+	ids.Lock()
+	defer ids.Unlock()
+	return ids.release(ctx, st, c)
 }
 
 // pow returns x**y, only uses int64 types instead float64.
@@ -245,29 +855,29 @@ func MultiLengthen(ctx context.Context, links []string) ([]ChangeResult, error)
 	if n > c.Settings.MaxPack {
 		return nil, fmt.Errorf("too big pack size [%v]", n)
 	}
-	s, err := db.CtxSession(ctx)
-	if err != nil {
-		return nil, err
-	}
-	coll, err := db.Coll(s, "urls")
+	st, err := db.CtxStorage(ctx)
 	if err != nil {
 		return nil, err
 	}
 	for _, link := range links {
-		id, err := Decode(link)
-		if err != nil {
-			c.L.Error.Printf("decode error [%v]: %v", link, err)
-			result = append(result, ChangeResult{Cu: &CustomURL{ID: id}, Err: "invalid value"})
-			continue
-		}
 		cu := &CustomURL{}
-		err = coll.FindId(id).One(cu)
+		if !isShortURL.MatchString(link) {
+			err = st.FindAlias(ctx, link, false, cu)
+		} else {
+			id, errDecode := Decode(link)
+			if errDecode != nil {
+				c.L.Error.Printf("decode error [%v]: %v", link, errDecode)
+				result = append(result, ChangeResult{Cu: &CustomURL{Alias: link}, Err: "invalid value"})
+				continue
+			}
+			err = st.FindURL(ctx, id, false, cu)
+		}
 		if err != nil {
 			msg := "internal error"
-			if err == mgo.ErrNotFound {
+			if err == db.ErrNotFound {
 				msg = "not found"
 			}
-			result = append(result, ChangeResult{Cu: &CustomURL{ID: id}, Err: msg})
+			result = append(result, ChangeResult{Cu: &CustomURL{Alias: link}, Err: msg})
 			continue
 		}
 		result = append(result, ChangeResult{Cu: cu})
@@ -276,42 +886,118 @@ func MultiLengthen(ctx context.Context, links []string) ([]ChangeResult, error)
 }
 
 // Lengthen converts a short link to original one.
-// It uses own database session if it's needed
+// It uses a storage from the context if it's needed
 // or it gets data from the cache.
 func Lengthen(ctx context.Context, short string) (*CustomURL, error) {
 	c, err := conf.FromContext(ctx)
 	if err != nil {
 		return nil, err
 	}
+	// the cache uses canonical keys, so they are removed by CustomURL.Keys
+	key := cacheKey(short)
 	cache, cacheOn := c.Cache.Strorage["URL"]
 	if cacheOn {
-		if cu, ok := cache.Get(short); ok {
+		if cu, ok := cache.Get(key); ok {
 			// c.L.Debug.Println("read from LRU cache", short)
 			return cu.(*CustomURL), nil
 		}
 	}
-	num, err := Decode(short)
+	st, err := db.CtxStorage(ctx)
 	if err != nil {
 		return nil, err
 	}
-	s, err := db.NewSession(c.Conn, false)
+	cu := &CustomURL{}
+	err = findShort(ctx, st, short, true, cu)
 	if err != nil {
 		return nil, err
 	}
-	defer s.Close()
-	coll, err := db.Coll(s, "urls")
+	if cacheOn {
+		cache.Add(key, cu)
+	}
+	return cu, nil
+}
+
+// cacheKey returns canonical form of short URL identifier,
+// leading zeros are removed, aliases are not changed.
+func cacheKey(short string) string {
+	if !isShortURL.MatchString(short) {
+		return short
+	}
+	num, err := Decode(short)
 	if err != nil {
-		return nil, err
+		return short
 	}
-	cu := &CustomURL{}
-	err = coll.Find(bson.D{{Name: "_id", Value: num}, {Name: "off", Value: false}}).One(cu)
+	return Encode(num)
+}
+
+// findShort finds short URL by its string identifier or alias.
+func findShort(ctx context.Context, st db.Storage, short string, active bool, cu *CustomURL) error {
+	if !isShortURL.MatchString(short) {
+		return st.FindAlias(ctx, short, active, cu)
+	}
+	num, err := Decode(short)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if cacheOn {
-		cache.Add(short, cu)
+	return st.FindURL(ctx, num, active, cu)
+}
+
+// ExpireTime returns expiration time of short URL, it is set by
+// TTL in hours or by absolute RFC 3339 date, nil is returned if both are empty.
+func ExpireTime(ttl uint64, expire string) (*time.Time, error) {
+	now := time.Now().UTC()
+	switch {
+	case expire != "":
+		t, err := time.Parse(time.RFC3339, expire)
+		if err != nil {
+			return nil, err
+		}
+		t = t.UTC()
+		if !t.After(now) {
+			return nil, errors.New("expiration date is in the past")
+		}
+		return &t, nil
+	case ttl > 0:
+		t := now.Add(time.Duration(ttl) * time.Hour)
+		return &t, nil
 	}
-	return cu, nil
+	return nil, nil
+}
+
+// Click checks that short URL can be used for one more redirect.
+// Expired or exhausted short URLs are removed from the cache
+// and db.ErrNotFound is returned for them.
+func Click(ctx context.Context, cu *CustomURL) error {
+	c, err := conf.FromContext(ctx)
+	if err != nil {
+		return err
+	}
+	evict := func() {
+		if cache, ok := c.Cache.Strorage["URL"]; ok {
+			for _, key := range cu.Keys() {
+				cache.Remove(key)
+			}
+		}
+	}
+	if cu.Expired() {
+		// it will be deactivated by the cleaner
+		evict()
+		return db.ErrNotFound
+	}
+	if cu.MaxClicks == 0 {
+		return nil
+	}
+	st, err := db.CtxStorage(ctx)
+	if err != nil {
+		return err
+	}
+	// cached item doesn't contain actual counter value,
+	// so the storage is always used
+	left, err := st.ClickURL(ctx, cu.ID)
+	if err != nil || left == 0 {
+		evict()
+	}
+	return err
 }
 
 // Shorten returns new short links.
@@ -329,60 +1015,278 @@ func Shorten(ctx context.Context, params []*ReqParams) ([]*CustomURL, error) {
 	if n > c.Settings.MaxPack {
 		return nil, fmt.Errorf("too big ReqParams pack size [%v]", n)
 	}
-	s, err := db.CtxSession(ctx)
-	if err != nil {
-		return nil, err
-	}
-	// prepare
-	coll, err := db.Coll(s, "urls")
+	st, err := db.CtxStorage(ctx)
 	if err != nil {
 		return nil, err
 	}
-	now := time.Now().UTC()
-	err = db.LockURL(s)
-	if err != nil {
-		return nil, err
+	for i, param := range params {
+		if err := CheckPolicy(c, param); err != nil {
+			return nil, &PolicyError{Item: i, Err: err}
+		}
 	}
-	defer db.UnlockURL(s)
-	num, err := getMax(coll)
-	if err != nil {
+	if err := checkAliases(ctx, st, params); err != nil {
 		return nil, err
 	}
-	documents := make([]interface{}, n)
+	now := time.Now().UTC()
 	cus := make([]*CustomURL, n)
+	documents := make([]interface{}, 0, n)
+	// created is used to find duplicates inside the pack,
+	// same contains indexes of duplicates and their first items.
+	created := make(map[dedupKey]int)
+	same := make(map[int]int)
 	for i, param := range params {
-		num++
+		norm, err := Normalize(param.Original)
+		if err != nil {
+			return nil, err
+		}
+		score, err := spamScore(ctx, param.URLs(), u.Name, param.Group)
+		if err != nil {
+			return nil, err
+		}
+		if score > float64(c.Settings.MaxSpam) {
+			c.L.Info.Printf("spam URL [%v] score=%v, user=%v", param.Original, score, u.Name)
+			return nil, ErrSpam
+		}
+		password, err := hashPassword(param.Password)
+		if err != nil {
+			return nil, err
+		}
+		random := param.Random || c.RandomCodes(param.Group)
+		if param.Alias == "" && (param.Dedup || c.Settings.Dedup) {
+			cu, err := findDuplicate(ctx, st, norm, u.Name, param, random)
+			if err != nil {
+				return nil, err
+			}
+			if cu != nil {
+				cus[i] = cu
+				continue
+			}
+			if param.reusable() {
+				key := dedupKey{norm, param.Group, param.Tag, param.Query, param.Suffix,
+					param.Code, param.NotDirect, param.Cb, random}
+				if j, ok := created[key]; ok {
+					same[i] = j
+					continue
+				}
+				created[key] = i
+			}
+		}
 		cus[i] = &CustomURL{
-			ID:        num,
+			Alias:     param.Alias,
 			Group:     param.Group,
 			Tag:       param.Tag,
 			Original:  param.Original,
+			Norm:      norm,
 			User:      u.Name,
 			TTL:       param.TTL,
+			MaxClicks: param.MaxClicks,
+			Left:      param.MaxClicks,
+			Password:  password,
+			Spam:      score,
+			Targets:   param.Targets,
+			Sticky:    param.Sticky,
+			Geo:       param.Geo,
+			Devices:   param.Devices,
+			Query:     param.Query,
+			Suffix:    param.Suffix,
+			Code:      param.Code,
 			NotDirect: param.NotDirect,
 			Created:   now,
 			Modified:  now,
 			Cb:        param.Cb,
 			API:       param.IsAPI,
 		}
-		documents[i] = cus[i]
+		if !random {
+			documents = append(documents, cus[i])
+		}
 	}
-	err = coll.Insert(documents...)
-	if err != nil {
-		return nil, err
+	if len(documents) > 0 {
+		// identifiers are taken from node's leased block
+		nums, err := ids.reserve(ctx, st, c, len(documents))
+		if err != nil {
+			return nil, err
+		}
+		for i, doc := range documents {
+			doc.(*CustomURL).ID = nums[i]
+		}
+		err = st.InsertURLs(ctx, documents...)
+		if err != nil {
+			if err == db.ErrDuplicate {
+				// an alias could be used concurrently
+				if errAlias := checkAliases(ctx, st, params); errAlias != nil {
+					return nil, errAlias
+				}
+				return nil, fmt.Errorf("short URL identifier is already used: %v", err)
+			}
+			return nil, err
+		}
+	}
+	for _, cu := range cus {
+		if cu != nil && cu.ID == 0 {
+			if err := insertRandom(ctx, st, c, cu); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for i, j := range same {
+		cu := *cus[j]
+		cu.Reused = true
+		cus[i] = &cu
 	}
 	return cus, nil
 }
 
-// IsShort checks link can be short URL.
+// dedupKey contains settings of a short URL which are compared to find duplicates.
+type dedupKey struct {
+	norm      string
+	group     string
+	tag       string
+	query     string
+	suffix    bool
+	code      int
+	notDirect bool
+	cb        CallBack
+	random    bool
+}
+
+// findDuplicate returns active short URL of the user with the same
+// normalized original URL and settings, nil is returned if it doesn't exist.
+func findDuplicate(ctx context.Context, st db.Storage, norm, user string, param *ReqParams, random bool) (*CustomURL, error) {
+	if !param.reusable() {
+		// new limits or routing rules differ from saved ones
+		return nil, nil
+	}
+	iter := st.DuplicateURLs(ctx, norm, user, param.Group)
+	for {
+		// new item for every document, so omitted fields are not kept from previous ones
+		cu := &CustomURL{}
+		if !iter.Next(cu) {
+			break
+		}
+		// old items have normalized URLs without fragments, so original ones are checked
+		orig, err := Normalize(cu.Original)
+		if err != nil || orig != norm {
+			continue
+		}
+		rules := len(cu.Targets) + len(cu.Geo) + len(cu.Devices)
+		same := cu.Alias == "" && cu.TTL == nil && cu.MaxClicks == 0 && !cu.Protected() && rules == 0 && cu.Tag == param.Tag &&
+			cu.Query == param.Query && cu.Suffix == param.Suffix && cu.Code == param.Code && cu.NotDirect == param.NotDirect &&
+			cu.Cb == param.Cb && (cu.ID >= db.RandomMin) == random
+		if same {
+			cu.Reused = true
+			return cu, iter.Close()
+		}
+	}
+	return nil, iter.Close()
+}
+
+// reusable returns true if parameters don't contain limits and routing rules,
+// so an existing short URL with the same settings can be used instead of new one.
+func (p *ReqParams) reusable() bool {
+	rules := len(p.Targets) + len(p.Geo) + len(p.Devices)
+	return p.TTL == nil && p.MaxClicks == 0 && p.Password == "" && rules == 0
+}
+
+// Normalize returns normalized URL, it is used to find duplicates:
+// scheme and host are in lower case, default port and empty path are omitted,
+// query parameters are sorted. Fragment is kept, because it can be a part of
+// client-side routing.
+func Normalize(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	switch {
+	case u.Scheme == "http" && strings.HasSuffix(u.Host, ":80"):
+		u.Host = strings.TrimSuffix(u.Host, ":80")
+	case u.Scheme == "https" && strings.HasSuffix(u.Host, ":443"):
+		u.Host = strings.TrimSuffix(u.Host, ":443")
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = u.Query().Encode()
+	}
+	return u.String(), nil
+}
+
+// insertRandom saves short URL with random identifier,
+// it tries again if generated identifier is already used.
+func insertRandom(ctx context.Context, st db.Storage, c *conf.Config, cu *CustomURL) error {
+	var err error
+	for i := 0; i < randomAttempts; i++ {
+		cu.ID, err = RandomID(c.RandomLen())
+		if err != nil {
+			return err
+		}
+		err = st.InsertURLs(ctx, cu)
+		if err != db.ErrDuplicate {
+			return err
+		}
+		c.L.Debug.Printf("random short URL %v is already used", cu)
+	}
+	if cu.Alias != "" {
+		return ErrAliasUsed
+	}
+	return errors.New("can not generate unique random short URL")
+}
+
+// checkAliases checks that requested aliases are not used yet.
+func checkAliases(ctx context.Context, st db.Storage, params []*ReqParams) error {
+	aliases := make(map[string]bool, len(params))
+	for _, param := range params {
+		if param.Alias == "" {
+			continue
+		}
+		if aliases[param.Alias] {
+			return ErrAliasUsed
+		}
+		aliases[param.Alias] = true
+		err := st.FindAlias(ctx, param.Alias, false, &CustomURL{})
+		switch {
+		case err == nil:
+			return ErrAliasUsed
+		case err != db.ErrNotFound:
+			return err
+		}
+	}
+	return nil
+}
+
+// SplitShort splits URL path to short URL (or its alias) and
+// a path suffix after it, the suffix is empty or starts with "/".
+func SplitShort(p string) (string, string, bool) {
+	var suffix string
+	short := strings.TrimPrefix(p, "/")
+	if i := strings.Index(short, "/"); i >= 0 {
+		short, suffix = short[:i], short[i:]
+	}
+	if suffix == "/" {
+		suffix = ""
+	}
+	if reservedAliases[strings.ToLower(short)] {
+		// service's paths are not short URLs
+		return short, suffix, false
+	}
+	link, ok := IsShort(short)
+	return link, suffix, ok
+}
+
+// IsShort checks link can be short URL or its alias.
 func IsShort(link string) (string, bool) {
 	pattern := strings.Trim(link, "/")
-	return pattern, isShortURL.MatchString(pattern)
+	if isShortURL.MatchString(pattern) {
+		return pattern, true
+	}
+	return pattern, ValidAlias(pattern) == nil
 }
 
-// Import imports short URLs.
-func Import(ctx context.Context, links map[string]*ReqParams) ([]ChangeResult, error) {
-	var result []ChangeResult
+// Import imports short URLs, results are returned in the same order as shorts,
+// every item has own result, repeated identifiers are reported as duplicates.
+func Import(ctx context.Context, shorts []string, params []*ReqParams) ([]ChangeResult, error) {
 	c, err := conf.FromContext(ctx)
 	if err != nil {
 		return nil, err
@@ -391,31 +1295,65 @@ func Import(ctx context.Context, links map[string]*ReqParams) ([]ChangeResult, e
 	if err != nil {
 		return nil, err
 	}
-	n := len(links)
+	n := len(shorts)
+	if n != len(params) {
+		return nil, errors.New("shorts and params sizes are different")
+	}
 	if n > c.Settings.MaxPack {
 		return nil, fmt.Errorf("too big pack size [%v]", n)
 	}
-	s, err := db.CtxSession(ctx)
-	if err != nil {
-		return nil, err
-	}
-	// prepare
-	coll, err := db.Coll(s, "urls")
+	st, err := db.CtxStorage(ctx)
 	if err != nil {
 		return nil, err
 	}
+	var maxID int64
 	now := time.Now().UTC()
-	for short, param := range links {
+	result := make([]ChangeResult, n)
+	seen := make(map[int64]bool, n)
+	for i, short := range shorts {
+		param := params[i]
+		// only values which can be found by findShort are allowed
+		if !isShortURL.MatchString(short) {
+			result[i].Err = "invalid short URL value"
+			continue
+		}
 		num, err := Decode(short)
+		if err != nil || num < 1 {
+			result[i].Err = "invalid short URL value"
+			continue
+		}
+		if seen[num] {
+			result[i].Err = "duplicate item"
+			continue
+		}
+		seen[num] = true
+		if err := CheckPolicy(c, param); err != nil {
+			result[i].Err = err.Error()
+			continue
+		}
+		norm, err := Normalize(param.Original)
+		if err != nil {
+			result[i].Err = err.Error()
+			continue
+		}
+		// identifiers of current nodes' leases can be used by nodes
+		leased, err := st.IsLeased(ctx, num)
 		if err != nil {
-			result = append(result, ChangeResult{Err: "invalid short URL value"})
+			return nil, err
+		}
+		if leased {
+			result[i].Err = "leased short URL"
 			continue
 		}
-		cu := &CustomURL{
+		if num < db.RandomMin && num > maxID {
+			maxID = num
+		}
+		result[i].Cu = &CustomURL{
 			ID:        num,
 			Group:     param.Group,
 			Tag:       param.Tag,
 			Original:  param.Original,
+			Norm:      norm,
 			User:      u.Name,
 			TTL:       param.TTL,
 			NotDirect: param.NotDirect,
@@ -424,59 +1362,345 @@ func Import(ctx context.Context, links map[string]*ReqParams) ([]ChangeResult, e
 			Cb:        param.Cb,
 			API:       param.IsAPI,
 		}
-		// a locking of every insert is not fast
-		// but the pack doesn't lock other operations.
-		err = db.LockURL(s)
-		if err != nil {
+	}
+	// move URLs counter forward before insert,
+	// so new leased blocks will not contain imported identifiers,
+	// random identifiers are out of sequential range.
+	if maxID > 0 {
+		if err := st.SyncURLs(ctx, maxID); err != nil {
 			return nil, err
 		}
-		errIns := coll.Insert(cu)
-		err = db.UnlockURL(s)
+	}
+	for i := range result {
+		if result[i].Cu == nil {
+			continue
+		}
+		if err := st.InsertURLs(ctx, result[i].Cu); err != nil {
+			msg := "internal error"
+			if err == db.ErrDuplicate {
+				msg = "duplicate item"
+			} else {
+				c.L.Error.Printf("import [%v] error: %v", shorts[i], err)
+			}
+			result[i] = ChangeResult{Err: msg}
+		}
+	}
+	return result, nil
+}
+
+// update changes short URL by edit request parameters and returns changed fields,
+// settings which are omitted in the request are kept.
+func (cu *CustomURL) update(param *ReqParams) (map[string]interface{}, error) {
+	set := make(map[string]interface{})
+	if param.has(FieldURL) {
+		norm, err := Normalize(param.Original)
+		if err != nil {
+			return nil, errInvalidValue
+		}
+		if cu.Norm != norm {
+			// new original URL should be checked again
+			cu.Health = nil
+			set["health"] = cu.Health
+		}
+		cu.Original, cu.Norm = param.Original, norm
+		set["orig"], set["norm"] = cu.Original, cu.Norm
+	}
+	if param.has(FieldPassword) {
+		password, err := hashPassword(param.Password)
 		if err != nil {
 			return nil, err
 		}
-		if errIns != nil {
+		cu.Password = password
+		set["pwd"] = cu.Password
+	}
+	if param.has(FieldClicks) {
+		cu.MaxClicks, cu.Left = param.MaxClicks, param.MaxClicks
+		set["max"], set["left"] = cu.MaxClicks, cu.Left
+	}
+	if param.has(FieldTag) {
+		cu.Tag = param.Tag
+		set["tag"] = cu.Tag
+	}
+	if param.has(FieldGroup) {
+		cu.Group = param.Group
+		set["group"] = cu.Group
+	}
+	if param.has(FieldTTL) {
+		cu.TTL = param.TTL
+		set["ttl"] = cu.TTL
+	}
+	if param.has(FieldNotDirect) {
+		cu.NotDirect = param.NotDirect
+		set["ndr"] = cu.NotDirect
+	}
+	if param.has(FieldTargets) {
+		cu.Targets = param.Targets
+		set["targets"] = cu.Targets
+	}
+	if param.has(FieldSticky) {
+		cu.Sticky = param.Sticky
+		set["sticky"] = cu.Sticky
+	}
+	if param.has(FieldGeo) {
+		cu.Geo = param.Geo
+		set["geo"] = cu.Geo
+	}
+	if param.has(FieldDevices) {
+		cu.Devices = param.Devices
+		set["devices"] = cu.Devices
+	}
+	if param.has(FieldQuery) {
+		cu.Query = param.Query
+		set["query"] = cu.Query
+	}
+	if param.has(FieldSuffix) {
+		cu.Suffix = param.Suffix
+		set["suffix"] = cu.Suffix
+	}
+	if param.has(FieldCode) {
+		cu.Code = param.Code
+		set["code"] = cu.Code
+	}
+	if param.has(FieldCb) {
+		cu.Cb = param.Cb
+		set["cb"] = cu.Cb
+	}
+	if cu.Protected() && KeepsMethod(cu.Code) {
+		return nil, errProtectedCode
+	}
+	cu.Modified = time.Now().UTC()
+	set["mod"] = cu.Modified
+	return set, nil
+}
+
+// Edit changes original URLs and settings of existing short URLs,
+// results are returned in the same order as shorts.
+// Only authors or administrators can edit short URLs.
+func Edit(ctx context.Context, shorts []string, params []*ReqParams) ([]ChangeResult, error) {
+	c, err := conf.FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	u, err := auth.ExtractUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	n := len(shorts)
+	if n != len(params) {
+		return nil, errors.New("shorts and params sizes are different")
+	}
+	if n > c.Settings.MaxPack {
+		return nil, fmt.Errorf("too big pack size [%v]", n)
+	}
+	st, err := db.CtxStorage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cache, cacheOn := c.Cache.Strorage["URL"]
+	result := make([]ChangeResult, n)
+	seen := make(map[int64]bool, n)
+	for i, short := range shorts {
+		param := params[i]
+		cu := &CustomURL{}
+		err := findShort(ctx, st, short, false, cu)
+		if err != nil {
 			msg := "internal error"
-			if mgo.IsDup(errIns) {
-				msg = "duplicate item"
+			if err == db.ErrNotFound {
+				msg = "not found"
+			}
+			result[i] = ChangeResult{Cu: &CustomURL{Alias: short}, Err: msg}
+			continue
+		}
+		if seen[cu.ID] {
+			result[i] = ChangeResult{Cu: cu, Err: "duplicate item"}
+			continue
+		}
+		seen[cu.ID] = true
+		if !canChange(u, cu) {
+			result[i] = ChangeResult{Cu: cu, Err: "permissions error"}
+			continue
+		}
+		set, err := cu.update(param)
+		if err != nil {
+			msg := "internal error"
+			if err == errProtectedCode || err == errInvalidValue {
+				msg = err.Error()
 			}
-			result = append(result, ChangeResult{Err: msg})
+			result[i] = ChangeResult{Cu: cu, Err: msg}
 			continue
 		}
+		// the changed short URL is checked completely
+		if err := checkURLs(c, cu.Group, cu.URLs()); err != nil {
+			result[i] = ChangeResult{Cu: cu, Err: err.Error()}
+			continue
+		}
+		score, err := spamScore(ctx, cu.URLs(), cu.User, cu.Group)
+		if err != nil {
+			c.L.Error.Printf("spam score error [%v]: %v", short, err)
+			result[i] = ChangeResult{Cu: cu, Err: "internal error"}
+			continue
+		}
+		if score > float64(c.Settings.MaxSpam) {
+			result[i] = ChangeResult{Cu: cu, Err: "spam URL"}
+			continue
+		}
+		cu.Spam = score
+		set["spam"] = cu.Spam
+		err = st.UpdateURL(ctx, cu.ID, set)
+		if err != nil {
+			c.L.Error.Printf("update error [%v]: %v", short, err)
+			result[i] = ChangeResult{Cu: cu, Err: "internal error"}
+			continue
+		}
+		if cacheOn {
+			for _, key := range cu.Keys() {
+				cache.Remove(key)
+			}
+		}
+		result[i] = ChangeResult{Cu: cu}
+	}
+	return result, nil
+}
+
+// canChange returns true if the user is an author of short URL or an administrator.
+func canChange(u *auth.User, cu *CustomURL) bool {
+	if u.HasRole("admin") {
+		return true
+	}
+	return !u.IsAnonymous() && cu.User == u.Name
+}
+
+// changeState updates fields of short URLs which are returned by the fn.
+// Only authors or administrators can do it.
+func changeState(ctx context.Context, links []string, fn func(u *auth.User, cu *CustomURL) (map[string]interface{}, error)) ([]ChangeResult, error) {
+	var result []ChangeResult
+	c, err := conf.FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	u, err := auth.ExtractUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	n := len(links)
+	if n > c.Settings.MaxPack {
+		return nil, fmt.Errorf("too big pack size [%v]", n)
+	}
+	st, err := db.CtxStorage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cache, cacheOn := c.Cache.Strorage["URL"]
+	for _, link := range links {
+		cu := &CustomURL{}
+		err := findShort(ctx, st, link, false, cu)
+		if err != nil {
+			msg := "internal error"
+			if err == db.ErrNotFound {
+				msg = "not found"
+			}
+			result = append(result, ChangeResult{Cu: &CustomURL{Alias: link}, Err: msg})
+			continue
+		}
+		if !canChange(u, cu) {
+			result = append(result, ChangeResult{Cu: cu, Err: "permissions error"})
+			continue
+		}
+		cu.Modified = time.Now().UTC()
+		set, err := fn(u, cu)
+		if err != nil {
+			result = append(result, ChangeResult{Cu: cu, Err: err.Error()})
+			continue
+		}
+		set["mod"] = cu.Modified
+		err = st.UpdateURL(ctx, cu.ID, set)
+		if err != nil {
+			c.L.Error.Printf("update error [%v]: %v", link, err)
+			result = append(result, ChangeResult{Cu: cu, Err: "internal error"})
+			continue
+		}
+		if cacheOn {
+			for _, key := range cu.Keys() {
+				cache.Remove(key)
+			}
+		}
 		result = append(result, ChangeResult{Cu: cu})
 	}
 	return result, nil
 }
 
+// disable deactivates short URL by the user,
+// a reason of already disabled link is kept.
+func (cu *CustomURL) disable() map[string]interface{} {
+	if !cu.Disabled {
+		cu.Disabled, cu.Reason = true, db.OffUser
+	}
+	return map[string]interface{}{"off": true, "why": cu.Reason}
+}
+
+// CanEnable returns true if the user can activate the short URL.
+// Links disabled by the system can be activated only by administrators,
+// expired or exhausted ones are allowed after TTL or clicks limit change.
+func (cu *CustomURL) CanEnable(u *auth.User) bool {
+	if u.HasRole("admin") {
+		return true
+	}
+	switch cu.Reason {
+	case db.OffSpam, db.OffHealth:
+		return false
+	case db.OffExpired:
+		return !cu.Expired()
+	case db.OffClicks:
+		return cu.Left > 0
+	}
+	return true
+}
+
+// Disable deactivates short URLs.
+func Disable(ctx context.Context, links []string) ([]ChangeResult, error) {
+	return changeState(ctx, links, func(u *auth.User, cu *CustomURL) (map[string]interface{}, error) {
+		return cu.disable(), nil
+	})
+}
+
+// Enable activates short URLs, it also restores them from trash.
+func Enable(ctx context.Context, links []string) ([]ChangeResult, error) {
+	return changeState(ctx, links, func(u *auth.User, cu *CustomURL) (map[string]interface{}, error) {
+		if !cu.CanEnable(u) {
+			return nil, errors.New("disabled by system")
+		}
+		cu.Disabled, cu.Deleted, cu.Reason = false, nil, ""
+		return map[string]interface{}{"off": false, "del": nil, "why": ""}, nil
+	})
+}
+
+// Delete moves short URLs to trash, they are deactivated and
+// will be removed by the cleaner after the trash period.
+func Delete(ctx context.Context, links []string) ([]ChangeResult, error) {
+	return changeState(ctx, links, func(u *auth.User, cu *CustomURL) (map[string]interface{}, error) {
+		now := cu.Modified
+		set := cu.disable()
+		cu.Deleted = &now
+		set["del"] = now
+		return set, nil
+	})
+}
+
 // Export exports URLs data.
 func Export(ctx context.Context, filter Filter) ([]*CustomURL, [3]int, error) {
 	var result []*CustomURL
 	pages := [3]int{1, 1, filter.PageSize}
-	s, err := db.CtxSession(ctx)
+	st, err := db.CtxStorage(ctx)
 	if err != nil {
 		return nil, pages, err
 	}
-	coll, err := db.Coll(s, "urls")
-	if err != nil {
-		return nil, pages, err
+	f := &db.Filter{
+		Group:  filter.Group,
+		Tag:    filter.Tag,
+		Period: filter.Period,
+		Active: filter.Active,
 	}
-	conditions := bson.M{"group": filter.Group, "tag": filter.Tag}
-	if filter.Active {
-		conditions["off"] = false
-	}
-	switch {
-	case filter.Period[0] != nil && filter.Period[1] != nil:
-		conditions["$and"] = []bson.M{
-			bson.M{"ts": bson.M{"$gte": *filter.Period[0]}},
-			bson.M{"ts": bson.M{"$lte": *filter.Period[1]}},
-		}
-	case filter.Period[0] != nil:
-		conditions["ts"] = bson.M{"$gte": *filter.Period[0]}
-	case filter.Period[1] != nil:
-		conditions["ts"] = bson.M{"$lte": *filter.Period[1]}
-	}
-	// TODO: add skip+limit
-	n, err := coll.Find(conditions).Count()
+	n, err := st.CountURLs(ctx, f)
 	if err != nil {
 		return nil, pages, err
 	}
@@ -494,8 +1718,13 @@ func Export(ctx context.Context, filter Filter) ([]*CustomURL, [3]int, error) {
 	case pages[0] > pages[1]:
 		pages[0] = pages[1]
 	}
-	err = coll.Find(conditions).Skip((pages[0] - 1) * pages[2]).Limit(pages[2]).Sort("-id").All(&result)
-	if err != nil {
+	cu := &CustomURL{}
+	iter := st.FilterURLs(ctx, f, (pages[0]-1)*pages[2], pages[2])
+	for iter.Next(cu) {
+		result = append(result, cu)
+		cu = &CustomURL{}
+	}
+	if err := iter.Close(); err != nil {
 		return nil, pages, err
 	}
 	return result, pages, nil
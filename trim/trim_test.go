@@ -4,7 +4,21 @@
 
 package trim
 
-import "testing"
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/z0rr0/luss/auth"
+	"github.com/z0rr0/luss/conf"
+	"github.com/z0rr0/luss/db"
+	"github.com/z0rr0/luss/device"
+	"github.com/z0rr0/luss/spam"
+)
 
 func TestEncode(t *testing.T) {
 	suite := map[int64]string{
@@ -35,6 +49,517 @@ func TestEncode(t *testing.T) {
 	}
 }
 
+func TestCacheKey(t *testing.T) {
+	values := map[string]string{"01": "1", "00a": "a", "b": "b", "my-alias": "my-alias", "0": "0"}
+	for k, v := range values {
+		if key := cacheKey(k); key != v {
+			t.Errorf("incorrect behavior [%v]: %v", k, key)
+		}
+	}
+}
+
+func TestValidAlias(t *testing.T) {
+	suite := map[string]bool{
+		"my-link":     true,
+		"my_link":     true,
+		"LongAlias11": true,
+		"abc":         false,
+		"api":         false,
+		"API-":        true,
+		"-abc":        false,
+		"a b":         false,
+		"static":      false,
+		"":            false,
+	}
+	for alias, ok := range suite {
+		if err := ValidAlias(alias); (err == nil) != ok {
+			t.Errorf("incorrect behavior: %v, %v", alias, err)
+		}
+		if _, short := IsShort("/" + alias); ok && !short {
+			t.Errorf("incorrect behavior: %v", alias)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	suite := map[string]string{
+		"http://example.com":                  "http://example.com/",
+		"HTTP://Example.COM:80/Path":          "http://example.com/Path",
+		"https://example.com:443/a?b=2&a=1#x": "https://example.com/a?a=1&b=2#x",
+		"https://app/#/a":                     "https://app/#/a",
+		"https://example.com:8443/a":          "https://example.com:8443/a",
+	}
+	for k, v := range suite {
+		if norm, err := Normalize(k); err != nil || norm != v {
+			t.Errorf("incorrect behavior: %v, %v", norm, err)
+		}
+	}
+}
+
+func TestExpireTime(t *testing.T) {
+	if ttl, err := ExpireTime(0, ""); err != nil || ttl != nil {
+		t.Errorf("incorrect behavior: %v, %v", ttl, err)
+	}
+	now := time.Now()
+	if ttl, err := ExpireTime(2, ""); err != nil || ttl == nil || ttl.Sub(now) < time.Hour {
+		t.Errorf("incorrect behavior: %v, %v", ttl, err)
+	}
+	expire := now.Add(time.Minute).Format(time.RFC3339)
+	if ttl, err := ExpireTime(2, expire); err != nil || ttl == nil || ttl.Sub(now) > time.Hour {
+		t.Errorf("incorrect behavior: %v, %v", ttl, err)
+	}
+	for _, v := range []string{"2016-01-02", now.Add(-time.Minute).Format(time.RFC3339)} {
+		if _, err := ExpireTime(0, v); err == nil {
+			t.Errorf("incorrect behavior: %v", v)
+		}
+	}
+}
+
+func TestPassword(t *testing.T) {
+	if h, err := hashPassword(""); err != nil || h != "" {
+		t.Errorf("incorrect behavior: %v, %v", h, err)
+	}
+	h, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cu := &CustomURL{Password: h}
+	if !cu.Protected() || !cu.CheckPassword("secret") || cu.CheckPassword("wrong") {
+		t.Error("incorrect behavior")
+	}
+}
+
+func TestTargets(t *testing.T) {
+	rp := &ReqParams{Original: "http://a", Targets: []Target{{URL: "http://b"}, {URL: "http://c", Weight: 3}}}
+	if err := rp.Valid(); err != nil || rp.Targets[0].Weight != 1 {
+		t.Errorf("incorrect behavior: %v, %v", err, rp.Targets)
+	}
+	if urls := rp.URLs(); len(urls) != 3 || urls[2] != "http://c" {
+		t.Errorf("incorrect behavior: %v", urls)
+	}
+	for _, target := range []Target{{URL: "b"}, {URL: "http://b", Weight: -1}} {
+		rp = &ReqParams{Original: "http://a", Targets: []Target{target}}
+		if err := rp.Valid(); err == nil {
+			t.Errorf("incorrect behavior: %v", target)
+		}
+	}
+	cu := &CustomURL{Original: "http://a"}
+	if v, u := cu.Destination(1); v != 0 || u != "http://a" {
+		t.Errorf("incorrect behavior: %v, %v", v, u)
+	}
+	cu.Targets = []Target{{URL: "http://b", Weight: 1}, {URL: "http://c", Weight: 3}}
+	if v, u := cu.Destination(2); v != 2 || u != "http://c" {
+		t.Errorf("incorrect behavior: %v, %v", v, u)
+	}
+	served := map[int]int{}
+	for i := 0; i < 1000; i++ {
+		v, _ := cu.Destination(5)
+		served[v]++
+	}
+	if len(served) != 2 || served[1] == 0 || served[2] < served[1] {
+		t.Errorf("incorrect behavior: %v", served)
+	}
+}
+
+func TestGeoRules(t *testing.T) {
+	rp := &ReqParams{Original: "http://a", Geo: []GeoRule{{Countries: []string{"de", "AT"}, URL: "http://b"}}}
+	if err := rp.Valid(); err != nil || rp.Geo[0].Countries[0] != "DE" {
+		t.Errorf("incorrect behavior: %v, %v", err, rp.Geo)
+	}
+	if urls := rp.URLs(); len(urls) != 2 || urls[1] != "http://b" {
+		t.Errorf("incorrect behavior: %v", urls)
+	}
+	for _, rule := range []GeoRule{{URL: "http://b"}, {Countries: []string{"DEU"}, URL: "http://b"}, {Countries: []string{"DE"}, URL: "b"}} {
+		rp = &ReqParams{Original: "http://a", Geo: []GeoRule{rule}}
+		if err := rp.Valid(); err == nil {
+			t.Errorf("incorrect behavior: %v", rule)
+		}
+	}
+	cu := &CustomURL{Original: "http://a", Geo: []GeoRule{
+		{Countries: []string{"DE", "AT"}, URL: "http://b"},
+		{Countries: []string{"AT", "US"}, URL: "http://c"},
+	}}
+	suite := map[string]string{"DE": "http://b", "AT": "http://b", "US": "http://c", "RU": "", "": ""}
+	for country, expected := range suite {
+		if u, ok := cu.GeoURL(country); u != expected || ok != (expected != "") {
+			t.Errorf("incorrect behavior [%v]: %v, %v", country, u, ok)
+		}
+	}
+}
+
+func TestDeviceRules(t *testing.T) {
+	rp := &ReqParams{Original: "http://a", Devices: []device.Rule{{Platform: device.IOS, URL: "itms-apps://itunes.apple.com/app/id1"}}}
+	if err := rp.Valid(); err != nil {
+		t.Error(err)
+	}
+	if urls := rp.URLs(); len(urls) != 2 {
+		t.Errorf("incorrect behavior: %v", urls)
+	}
+	for _, rule := range []device.Rule{{Platform: "tv", URL: "http://b"}, {Platform: device.Android, URL: "b"}} {
+		rp = &ReqParams{Original: "http://a", Devices: []device.Rule{rule}}
+		if err := rp.Valid(); err == nil {
+			t.Errorf("incorrect behavior: %v", rule)
+		}
+	}
+}
+
+func TestSpamScore(t *testing.T) {
+	scorer := spam.Blocklist{"spam.com": true}
+	cu := &CustomURL{
+		Original: "http://example.com",
+		Targets:  []Target{{URL: "http://example.com/a", Weight: 1}},
+		Devices:  []device.Rule{{Platform: "ios", URL: "http://www.spam.com"}},
+	}
+	if urls := cu.URLs(); len(urls) != 3 {
+		t.Errorf("invalid behavior: %v", urls)
+	}
+	score, err := cu.SpamScore(context.Background(), scorer)
+	if err != nil || score != spam.MaxScore {
+		t.Errorf("invalid behavior: %v, %v", score, err)
+	}
+	cu.Devices = nil
+	if score, err = cu.SpamScore(context.Background(), scorer); err != nil || score != 0 {
+		t.Errorf("invalid behavior: %v, %v", score, err)
+	}
+}
+
+func TestRedirectCode(t *testing.T) {
+	suite := []struct {
+		rp *ReqParams
+		ok bool
+	}{
+		{&ReqParams{Original: "http://a", Code: 301}, true},
+		{&ReqParams{Original: "http://a", Code: 308}, true},
+		{&ReqParams{Original: "http://a", Code: 303}, false},
+		{&ReqParams{Original: "http://a", Code: 302, Password: "secret"}, true},
+		{&ReqParams{Original: "http://a", Code: 307, Password: "secret"}, false},
+	}
+	for i, v := range suite {
+		if err := v.rp.Valid(); (err == nil) != v.ok {
+			t.Errorf("incorrect behavior [%v]: %v", i, err)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	ttl := time.Now().Add(time.Hour)
+	cu := &CustomURL{Original: "http://a", Norm: "http://a/", Password: "hash", MaxClicks: 10, Tag: "tag",
+		TTL: &ttl, Targets: []Target{{URL: "http://b", Weight: 1}}, Health: &Health{Status: 200}}
+	set, err := cu.update(&ReqParams{Original: "http://a", Fields: FieldURL | FieldCode, Code: 302})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set) != 4 || set["code"] != 302 || cu.Health == nil {
+		t.Errorf("incorrect behavior: %v", set)
+	}
+	if cu.Password != "hash" || cu.MaxClicks != 10 || cu.Tag != "tag" || cu.TTL == nil || len(cu.Targets) != 1 {
+		t.Errorf("incorrect behavior: %v", cu)
+	}
+	if _, err := cu.update(&ReqParams{Fields: FieldCode, Code: 307}); err != errProtectedCode {
+		t.Errorf("incorrect behavior: %v", err)
+	}
+	set, err = cu.update(&ReqParams{Original: "http://b", MaxClicks: 5, Fields: FieldURL | FieldClicks | FieldPassword | FieldTTL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set["pwd"] != "" || set["left"] != int64(5) || cu.Health != nil || cu.TTL != nil || cu.Tag != "tag" {
+		t.Errorf("incorrect behavior: %v", set)
+	}
+	if err := (&ReqParams{Fields: FieldTag, Tag: "new"}).Valid(); err != nil {
+		t.Errorf("incorrect behavior: %v", err)
+	}
+}
+
+func TestCanEnable(t *testing.T) {
+	owner, admin := &auth.User{Name: "owner"}, &auth.User{Name: "root", Roles: []string{"admin"}}
+	past := time.Now().Add(-time.Hour)
+	suite := []struct {
+		cu       *CustomURL
+		owner    bool
+		disabled string
+	}{
+		{&CustomURL{}, true, db.OffUser},
+		{&CustomURL{Disabled: true, Reason: db.OffSpam}, false, db.OffSpam},
+		{&CustomURL{Disabled: true, Reason: db.OffHealth}, false, db.OffHealth},
+		{&CustomURL{Disabled: true, Reason: db.OffClicks}, false, db.OffClicks},
+		{&CustomURL{Disabled: true, Reason: db.OffClicks, Left: 3}, true, db.OffClicks},
+		{&CustomURL{Disabled: true, Reason: db.OffExpired, TTL: &past}, false, db.OffExpired},
+	}
+	for i, v := range suite {
+		if set := v.cu.disable(); set["why"] != v.disabled {
+			t.Errorf("incorrect behavior [%v]: %v", i, set)
+		}
+		if v.cu.CanEnable(owner) != v.owner || !v.cu.CanEnable(admin) {
+			t.Errorf("incorrect behavior [%v]", i)
+		}
+	}
+}
+
+func TestForward(t *testing.T) {
+	suite := []struct {
+		cu          CustomURL
+		dst, suffix string
+		query       string
+		requestWins bool
+		expected    string
+	}{
+		{CustomURL{}, "http://a/b?x=1", "/c", "x=2", false, "http://a/b?x=1"},
+		{CustomURL{Suffix: true}, "http://a/b/", "/c%20d", "", false, "http://a/b/c%20d"},
+		{CustomURL{Query: QueryAppend}, "http://a/b?x=1", "", "x=2&y=3", false, "http://a/b?x=1&x=2&y=3"},
+		{CustomURL{Query: QueryAppend}, "http://a/b", "", "y=3", false, "http://a/b?y=3"},
+		{CustomURL{Query: QueryMerge}, "http://a/b?x=1", "", "x=2&y=3", false, "http://a/b?x=1&y=3"},
+		{CustomURL{Query: QueryMerge}, "http://a/b?x=1", "", "x=2&y=3", true, "http://a/b?x=2&y=3"},
+		{CustomURL{Query: QueryMerge, Suffix: true}, "http://a/b", "/c", "y=3", false, "http://a/b/c?y=3"},
+	}
+	for i, v := range suite {
+		u, err := v.cu.Forward(v.dst, v.suffix, v.query, v.requestWins)
+		if err != nil || u != v.expected {
+			t.Errorf("incorrect behavior [%v]: %v, %v", i, u, err)
+		}
+	}
+	cu := CustomURL{Query: QueryMerge}
+	if _, err := cu.Forward("http://a/b", "", "x=%zz", false); err == nil {
+		t.Error("incorrect behavior")
+	}
+}
+
+func TestSplitShort(t *testing.T) {
+	suite := []struct {
+		p, short, suffix string
+		ok               bool
+	}{
+		{"/abc", "abc", "", true},
+		{"/abc/", "abc", "", true},
+		{"/abc/d/e", "abc", "/d/e", true},
+		{"/a-b/d", "a-b", "/d", true},
+		{"/", "", "", false},
+		{"/api/unknown", "", "", false},
+		{"/test/x", "", "", false},
+		{"/Error", "", "", false},
+	}
+	for i, v := range suite {
+		short, suffix, ok := SplitShort(v.p)
+		if ok != v.ok || (ok && (short != v.short || suffix != v.suffix)) {
+			t.Errorf("incorrect behavior [%v]: %v, %v, %v", i, short, suffix, ok)
+		}
+	}
+}
+
+func TestRandomID(t *testing.T) {
+	for _, n := range []int{7, 8, 10} {
+		for i := 0; i < 100; i++ {
+			id, err := RandomID(n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			code := Encode(id)
+			if id < db.RandomMin || len(code) != n {
+				t.Errorf("incorrect behavior: %v, %v", id, code)
+			}
+			if _, ok := IsShort("/" + code); !ok {
+				t.Errorf("incorrect behavior: %v", code)
+			}
+		}
+	}
+	if Encode(db.RandomMin) != "1000000" {
+		t.Errorf("incorrect behavior: %v", Encode(db.RandomMin))
+	}
+}
+
+func TestReserve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "luss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &conf.Conn{Storage: &conf.StorageCfg{Engine: conf.BoltEngine, File: filepath.Join(dir, "luss.db")}}
+	defer c.Close()
+	st, err := db.NewBolt(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg1, cfg2 := &conf.Config{}, &conf.Config{}
+	cfg1.Settings.Node, cfg1.Settings.IDBlock, cfg1.Settings.LockTTL = "node1", 3, 60
+	cfg2.Settings.Node, cfg2.Settings.IDBlock, cfg2.Settings.LockTTL = "node2", 3, 60
+	ctx := context.Background()
+
+	b := &idBlock{}
+	nums, err := b.reserve(ctx, st, cfg1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nums) != 2 || nums[0] != 1 || nums[1] != 2 {
+		t.Errorf("invalid behavior: %v", nums)
+	}
+	// other node gets own block
+	nums, err = (&idBlock{}).reserve(ctx, st, cfg2, 1)
+	if err != nil || nums[0] != 4 {
+		t.Errorf("invalid behavior: %v, %v", nums, err)
+	}
+	// it uses a tail of the current block and a new one
+	nums, err = b.reserve(ctx, st, cfg1, 2)
+	if err != nil || nums[0] != 3 || nums[1] != 7 {
+		t.Errorf("invalid behavior: %v, %v", nums, err)
+	}
+	if leased, err := st.IsLeased(ctx, 8); err != nil || !leased {
+		t.Errorf("invalid behavior: %v, %v", leased, err)
+	}
+	if leased, err := st.IsLeased(ctx, 3); err != nil || leased {
+		t.Errorf("invalid behavior: %v, %v", leased, err)
+	}
+	// the node's block is locked by the current process
+	if err := st.AcquireLock(ctx, "ids:node1", "other", time.Minute); err != db.ErrLocked {
+		t.Errorf("invalid behavior: %v", err)
+	}
+	// restart of the node, item 7 was saved
+	if err := b.release(ctx, st, cfg1); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.AcquireLock(ctx, "ids:node1", "other", time.Minute); err != nil {
+		t.Errorf("invalid behavior: %v", err)
+	}
+	if err := st.ReleaseLock(ctx, "ids:node1", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.InsertURLs(ctx, &CustomURL{ID: 7}); err != nil {
+		t.Fatal(err)
+	}
+	nums, err = (&idBlock{}).reserve(ctx, st, cfg1, 1)
+	if err != nil || nums[0] != 8 {
+		t.Errorf("invalid behavior: %v, %v", nums, err)
+	}
+}
+
+func testContext(t *testing.T, dir string) context.Context {
+	cfg := &conf.Config{Conn: &conf.Conn{Storage: &conf.StorageCfg{Engine: conf.BoltEngine, File: filepath.Join(dir, "luss.db")}}}
+	cfg.Settings.Node, cfg.Settings.MaxPack = "node1", 10
+	st, err := db.NewBolt(cfg.Conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := db.NewContext(conf.NewContext(cfg), st)
+	ctx, err = auth.CheckToken(ctx, httptest.NewRequest("POST", "/api/add", nil), true)
+	if err != auth.ErrAnonymous {
+		t.Fatal(err)
+	}
+	ctx, err = auth.Authenticate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+func TestImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "luss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := testContext(t, dir)
+	shorts := []string{"b", "?", "b", "c", "", "-abc", "0"}
+	params := make([]*ReqParams, len(shorts))
+	for i := range params {
+		params[i] = &ReqParams{Original: "http://example.com"}
+	}
+	result, err := Import(ctx, shorts, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := []string{"", "invalid short URL value", "duplicate item", "", "invalid short URL value",
+		"invalid short URL value", "invalid short URL value"}
+	for i, r := range result {
+		if r.Err != errs[i] || (r.Err == "") != (r.Cu != nil) {
+			t.Errorf("invalid behavior [%v]: %v", i, r)
+		}
+	}
+	// existing item doesn't stop others
+	result, err = Import(ctx, []string{"c", "d"}, params[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 || result[0].Err != "duplicate item" || result[1].Cu == nil || result[1].Cu.String() != "d" {
+		t.Errorf("invalid behavior: %v", result)
+	}
+}
+
+func TestEdit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "luss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := testContext(t, dir)
+	param := &ReqParams{Original: "http://example.com"}
+	if _, err := Import(ctx, []string{"b", "c"}, []*ReqParams{param, param}); err != nil {
+		t.Fatal(err)
+	}
+	shorts := []string{"c", "b", "c", "zz"}
+	result, err := Edit(ctx, shorts, []*ReqParams{param, param, param, param})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// anonymous user can't change links
+	errs := []string{"permissions error", "permissions error", "duplicate item", "not found"}
+	for i, r := range result {
+		if r.Err != errs[i] || r.Cu.String() != shorts[i] {
+			t.Errorf("invalid behavior [%v]: %v", i, r)
+		}
+	}
+}
+
+func TestShortenPack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "luss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := testContext(t, dir)
+	params := []*ReqParams{
+		{Original: "http://example.com/a", Dedup: true},
+		{Original: "http://EXAMPLE.com/a", Dedup: true},
+		{Original: "http://example.com/a", Dedup: true, Tag: "other"},
+	}
+	cus, err := Shorten(ctx, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cus[0].ID != cus[1].ID || cus[0].Reused || !cus[1].Reused || cus[2].ID == cus[0].ID {
+		t.Errorf("invalid behavior: %v, %v, %v", cus[0], cus[1], cus[2])
+	}
+	// fields of skipped candidates are not kept
+	params = []*ReqParams{
+		{Original: "http://example.com/d", Alias: "first"},
+		{Original: "http://example.com/d"},
+		{Original: "http://example.com/d", Alias: "last"},
+	}
+	if cus, err = Shorten(ctx, params); err != nil {
+		t.Fatal(err)
+	}
+	reused, err := Shorten(ctx, []*ReqParams{{Original: "http://example.com/d", Dedup: true}})
+	if err != nil || !reused[0].Reused || reused[0].ID != cus[1].ID {
+		t.Errorf("invalid behavior: %v, %v", reused, err)
+	}
+	// fragments are different destinations
+	if cus, err = Shorten(ctx, []*ReqParams{{Original: "https://app/#/a", Dedup: true}}); err != nil {
+		t.Fatal(err)
+	}
+	reused, err = Shorten(ctx, []*ReqParams{{Original: "https://app/#/b", Dedup: true}})
+	if err != nil || reused[0].Reused || reused[0].ID == cus[0].ID {
+		t.Errorf("invalid behavior: %v, %v", reused, err)
+	}
+	// used alias stops all pack
+	params = []*ReqParams{
+		{Original: "http://example.com/b"},
+		{Original: "http://example.com/c", Alias: "test"},
+	}
+	if _, err := Shorten(ctx, params[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Shorten(ctx, params); err == nil {
+		t.Error("invalid behavior")
+	}
+}
+
 func BenchmarkEncode(b *testing.B) {
 	// max 9223372036854775807 == AzL8n0Y58m7
 	x := "AzL8n0Y58m7"